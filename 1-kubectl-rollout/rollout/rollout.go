@@ -20,22 +20,24 @@ import (
 
 // Loosely adapted from
 // https://github.com/kubernetes/kubectl/blob/5b27ac0ca2ba4fc3453941fcc23ebb54e35a099f/pkg/cmd/rollout/rollout_status.go
-func WatchRollout(ctx context.Context, c dynamic.Interface, name string, revision int64) error {
+//
+// Each status message is passed to report.
+func WatchRollout(ctx context.Context, c dynamic.Interface, namespace, name string, revision int64, report func(status string)) error {
 	fieldSelector := fields.OneTermEqualSelector("metadata.name", name).String()
 	deployment := appsv1.SchemeGroupVersion.WithResource("deployments")
 	lw := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 			options.FieldSelector = fieldSelector
-			return c.Resource(deployment).Namespace("default").List(context.TODO(), options)
+			return c.Resource(deployment).Namespace(namespace).List(ctx, options)
 		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 			options.FieldSelector = fieldSelector
-			return c.Resource(deployment).Namespace("default").Watch(context.TODO(), options)
+			return c.Resource(deployment).Namespace(namespace).Watch(ctx, options)
 		},
 	}
 
 	// if the rollout isn't done yet, keep watching deployment status
-	ctx, cancel := watchtools.ContextWithOptionalTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := watchtools.ContextWithOptionalTimeout(ctx, 10*time.Second)
 	intr := interrupt.New(nil, cancel)
 	statusViewer := &polymorphichelpers.DeploymentStatusViewer{}
 	return intr.Run(func() error {
@@ -46,7 +48,7 @@ func WatchRollout(ctx context.Context, c dynamic.Interface, name string, revisio
 				if err != nil {
 					return false, err
 				}
-				fmt.Printf("%s", status)
+				report(status)
 				// Quit waiting if the rollout is done
 				if done {
 					return true, nil
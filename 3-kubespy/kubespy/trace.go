@@ -1,16 +1,22 @@
 package kubespy
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"strconv"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/mbrlabs/uilive"
+	"github.com/pulumi/kubespy/k8sobject"
 	"github.com/pulumi/kubespy/print"
 	"github.com/pulumi/kubespy/watch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	k8sWatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 )
 
 const (
@@ -19,30 +25,148 @@ const (
 	v1Pod        = "v1/Pod"
 	deployment   = "Deployment"
 	v1ReplicaSet = "v1/ReplicaSet"
+
+	deploymentRevisionKey = "deployment.kubernetes.io/revision"
 )
 
-// Forked from
-// https://github.com/pulumi/kubespy/blob/438edbfd5a9a72992803d45addb1f45b10a0b62f/cmd/trace.go
-func TraceDeployment(namespace, name string) {
+var (
+	deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	replicaSetGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	podGVR        = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+// DeploymentEvents are the watch streams that TraceDeployment reads from.
+type DeploymentEvents struct {
+	Deployment  <-chan k8sWatch.Event
+	ReplicaSets <-chan k8sWatch.Event
+	Pods        <-chan k8sWatch.Event
+
+	// Stop, if set, closes the watches. watch.Forever watches can't be
+	// stopped, so WatchDeployment leaves it nil.
+	Stop func()
+}
+
+// WatchDeployment opens the same watches as `kubespy trace deploy`.
+func WatchDeployment(namespace, name string) (DeploymentEvents, error) {
 	// API server should rewrite this to apps/v1beta2, apps/v1beta2, or apps/v1 as appropriate.
 	deploymentEvents, err := watch.Forever("apps/v1", "Deployment",
 		watch.ThisObject(namespace, name))
 	if err != nil {
-		log.Fatal(err)
+		return DeploymentEvents{}, err
 	}
 
 	replicaSetEvents, err := watch.Forever("apps/v1", "ReplicaSet",
 		watch.ObjectsOwnedBy(namespace, name))
 	if err != nil {
-		log.Fatal(err)
+		return DeploymentEvents{}, err
 	}
 
 	podEvents, err := watch.Forever("v1", "Pod", watch.All(namespace))
 	if err != nil {
-		log.Fatal(err)
+		return DeploymentEvents{}, err
+	}
+
+	return DeploymentEvents{
+		Deployment:  deploymentEvents,
+		ReplicaSets: replicaSetEvents,
+		Pods:        podEvents,
+	}, nil
+}
+
+// WatchDeploymentForClient opens the same watches as WatchDeployment with an
+// existing client, e.g., a fake in a simulated cluster.
+//
+// Unlike watch.Forever, it lists the existing objects first, so it works with
+// fakes that don't send an initial ADDED event for each object.
+func WatchDeploymentForClient(client dynamic.Interface, namespace, name string) (DeploymentEvents, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	deploymentEvents, err := watchForClient(ctx, client.Resource(deploymentGVR).Namespace(namespace),
+		watch.ThisObject(namespace, name))
+	if err != nil {
+		cancel()
+		return DeploymentEvents{}, err
+	}
+
+	replicaSetEvents, err := watchForClient(ctx, client.Resource(replicaSetGVR).Namespace(namespace),
+		watch.ObjectsOwnedBy(namespace, name))
+	if err != nil {
+		cancel()
+		return DeploymentEvents{}, err
 	}
 
+	podEvents, err := watchForClient(ctx, client.Resource(podGVR).Namespace(namespace), watch.All(namespace))
+	if err != nil {
+		cancel()
+		return DeploymentEvents{}, err
+	}
+
+	return DeploymentEvents{
+		Deployment:  deploymentEvents,
+		ReplicaSets: replicaSetEvents,
+		Pods:        podEvents,
+		Stop:        cancel,
+	}, nil
+}
+
+func watchForClient(ctx context.Context, client dynamic.ResourceInterface, opts watch.Opts) (<-chan k8sWatch.Event, error) {
+	list, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := client.Watch(ctx, metav1.ListOptions{ResourceVersion: list.GetResourceVersion()})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan k8sWatch.Event)
+	send := func(e k8sWatch.Event) bool {
+		o, isUnst := e.Object.(*unstructured.Unstructured)
+		if !isUnst || !opts.Check(o) {
+			return true
+		}
+		select {
+		case out <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer watcher.Stop()
+		for i := range list.Items {
+			if !send(k8sWatch.Event{Type: k8sWatch.Added, Object: &list.Items[i]}) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-watcher.ResultChan():
+				if !ok || !send(e) {
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Forked from
+// https://github.com/pulumi/kubespy/blob/438edbfd5a9a72992803d45addb1f45b10a0b62f/cmd/trace.go
+//
+// Unlike kubespy, which traces forever, TraceDeployment returns nil
+// when the rollout succeeds and an error when the rollout fails or ctx is done.
+// Every time the rollout status changes, it's passed to report, along with
+// the pods kubespy attributes to the current ReplicaSet.
+func TraceDeployment(ctx context.Context, namespace, name string, events DeploymentEvents,
+	out io.Writer, report func(status string, pods []string)) error {
 	writer := uilive.New()
+	writer.Out = out
 	writer.RefreshInterval = time.Minute * 1
 	writer.Start()      // Start listening for updates, render.
 	defer writer.Stop() // Flush buffers, stop rendering.
@@ -56,16 +180,19 @@ func TraceDeployment(namespace, name string) {
 	repSets := map[string]k8sWatch.Event{} // Deployment name -> Pod
 	pods := map[string]k8sWatch.Event{}    // ReplicaSet name -> Pod
 
+	lastStatus := ""
 	for {
 		select {
-		case e := <-deploymentEvents:
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-events.Deployment:
 			if e.Type == k8sWatch.Deleted {
 				o := e.Object.(*unstructured.Unstructured)
 				delete(o.Object, "spec")
 				delete(o.Object, "status")
 			}
 			table[deployment] = []k8sWatch.Event{e}
-		case e := <-replicaSetEvents:
+		case e := <-events.ReplicaSets:
 			o := e.Object.(*unstructured.Unstructured)
 			if e.Type == k8sWatch.Deleted {
 				delete(repSets, o.GetName())
@@ -76,7 +203,7 @@ func TraceDeployment(namespace, name string) {
 			for _, rsEvent := range repSets {
 				table[v1ReplicaSet] = append(table[v1ReplicaSet], rsEvent)
 			}
-		case e := <-podEvents:
+		case e := <-events.Pods:
 			o := e.Object.(*unstructured.Unstructured)
 			if e.Type == k8sWatch.Deleted {
 				delete(pods, o.GetName())
@@ -90,5 +217,98 @@ func TraceDeployment(namespace, name string) {
 			}
 		}
 		print.DeploymentWatchTable(writer, table)
+
+		status, done, err := rolloutStatus(table)
+		if status != lastStatus {
+			lastStatus = status
+			report(status, currentPods(table))
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// rolloutStatus interprets the table the same way print.DeploymentWatchTable
+// does: the rollout is successful when the Deployment's Progressing condition
+// reports NewReplicaSetAvailable and has failed when Progressing is False.
+func rolloutStatus(table map[string][]k8sWatch.Event) (string, bool, error) {
+	events, ok := table[deployment]
+	if !ok {
+		return "Waiting for Deployment", false, nil
+	}
+	if events[0].Type == k8sWatch.Deleted {
+		return "", false, fmt.Errorf("Deployment has been deleted")
+	}
+
+	o := events[0].Object.(*unstructured.Unstructured)
+	revision, err := parseRevision(o)
+	if err != nil {
+		return "Waiting for controller to create Deployment", false, nil
+	}
+	if currentReplicaSet(table) == nil {
+		return fmt.Sprintf("Waiting for Deployment controller to create ReplicaSet for revision %d", revision), false, nil
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(o.Object, "status", "conditions")
+	for _, rawCondition := range conditions {
+		condition, isMap := rawCondition.(map[string]interface{})
+		if !isMap || condition["type"] != "Progressing" {
+			continue
+		}
+
+		reason, _ := condition["reason"].(string)
+		message, _ := condition["message"].(string)
+		if condition["status"] != "True" {
+			return "", false, fmt.Errorf("Rollout has failed; controller is no longer rolling forward: [%s] %s",
+				reason, message)
+		}
+		if reason == "NewReplicaSetAvailable" {
+			return fmt.Sprintf("Rollout successful: revision %d marked 'available'", revision), true, nil
+		}
+		return fmt.Sprintf("Rollout proceeding: [%s] %s", reason, message), false, nil
+	}
+	return "Deployment has not begun to roll out the change", false, nil
+}
+
+func currentReplicaSet(table map[string][]k8sWatch.Event) *unstructured.Unstructured {
+	events, ok := table[deployment]
+	if !ok {
+		return nil
+	}
+	revision, err := parseRevision(events[0].Object.(*unstructured.Unstructured))
+	if err != nil {
+		return nil
 	}
+	for _, e := range table[v1ReplicaSet] {
+		rs := e.Object.(*unstructured.Unstructured)
+		rsRevision, err := parseRevision(rs)
+		if err == nil && rsRevision == revision && e.Type != k8sWatch.Deleted {
+			return rs
+		}
+	}
+	return nil
+}
+
+// currentPods returns the names of pods owned by the current ReplicaSet.
+func currentPods(table map[string][]k8sWatch.Event) []string {
+	rs := currentReplicaSet(table)
+	if rs == nil {
+		return nil
+	}
+	result := []string{}
+	for _, e := range table[v1Pod] {
+		pod := e.Object.(*unstructured.Unstructured)
+		if k8sobject.OwnedBy(pod, rs.GetAPIVersion(), rs.GetKind(), rs.GetName()) {
+			result = append(result, pod.GetName())
+		}
+	}
+	return result
+}
+
+func parseRevision(o *unstructured.Unstructured) (int, error) {
+	return strconv.Atoi(o.GetAnnotations()[deploymentRevisionKey])
 }
@@ -0,0 +1,130 @@
+package tilt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The kinds a Deployment creates.
+var DeploymentDescendantKinds = []schema.GroupVersionKind{
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	{Version: "v1", Kind: "Pod"},
+}
+
+// The inverse of ObjectRefTree: an object and everything that it owns,
+// directly or indirectly.
+type DescendantTree struct {
+	Ref        v1.ObjectReference `json:"ref"`
+	Dependents []DescendantTree   `json:"dependents,omitempty"`
+
+	// Set when this object already appears further up the tree, i.e.,
+	// it owns itself. Its dependents are cut off to break the cycle.
+	Cyclic bool `json:"cyclic,omitempty"`
+}
+
+func (t DescendantTree) ContainsUID(uid types.UID) bool {
+	if t.Ref.UID == uid {
+		return true
+	}
+	for _, dependent := range t.Dependents {
+		if dependent.ContainsUID(uid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t DescendantTree) stringLines() []string {
+	line := fmt.Sprintf("%s:%s", t.Ref.Kind, t.Ref.Name)
+	if t.Cyclic {
+		line += " (cycle)"
+	}
+	result := []string{line}
+	for _, dependent := range t.Dependents {
+		// indent each of the dependents by two spaces
+		branchLines := dependent.stringLines()
+		for _, branchLine := range branchLines {
+			result = append(result, fmt.Sprintf("  %s", branchLine))
+		}
+	}
+	return result
+}
+
+func (t DescendantTree) String() string {
+	return strings.Join(t.stringLines(), "\n")
+}
+
+// DescendantsOf finds every object whose owner references lead back to ref,
+// e.g., the ReplicaSets and Pods of a Deployment.
+//
+// We can only find objects in the batch cache, so we fetch the given kinds
+// in ref's namespace first. Dependents of other kinds are only found if
+// something else already fetched them.
+func (v *OwnerFetcher) DescendantsOf(ctx context.Context, ref v1.ObjectReference, kinds ...schema.GroupVersionKind) (DescendantTree, error) {
+	if ref.UID == "" {
+		return DescendantTree{}, fmt.Errorf("Can only get descendants of deployed entities")
+	}
+
+	for _, gvk := range kinds {
+		err := v.ensureResourceFetched(ctx, gvk, ref.Namespace)
+		if err != nil {
+			return DescendantTree{}, err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.descendantsOfHelper(ref, map[types.UID]bool{}), nil
+}
+
+// Must hold the lock.
+func (v *OwnerFetcher) descendantsOfHelper(ref v1.ObjectReference, ancestors map[types.UID]bool) DescendantTree {
+	tree := DescendantTree{Ref: ref}
+	if ancestors[ref.UID] {
+		tree.Cyclic = true
+		return tree
+	}
+	ancestors[ref.UID] = true
+	defer delete(ancestors, ref.UID)
+
+	for uid := range v.dependents[ref.UID] {
+		dependentRef, ok := v.cachedRef(uid)
+		if !ok {
+			continue
+		}
+		tree.Dependents = append(tree.Dependents, v.descendantsOfHelper(dependentRef, ancestors))
+	}
+
+	sort.Slice(tree.Dependents, func(i, j int) bool {
+		a, b := tree.Dependents[i].Ref, tree.Dependents[j].Ref
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return tree
+}
+
+// The reference to an object in the batch cache.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) cachedRef(uid types.UID) (v1.ObjectReference, bool) {
+	cached, ok := v.metaCache[uid]
+	if !ok {
+		return v1.ObjectReference{}, false
+	}
+	apiVersion, kind := cached.gvk.ToAPIVersionAndKind()
+	return v1.ObjectReference{
+		Name:       cached.meta.GetName(),
+		Namespace:  cached.meta.GetNamespace(),
+		Kind:       kind,
+		UID:        uid,
+		APIVersion: apiVersion,
+	}, true
+}
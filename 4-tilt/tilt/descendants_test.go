@@ -0,0 +1,140 @@
+package tilt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDescendantsOfReturnsFetchErrors(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	client := newTestMetadataClient(deployment)
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewServiceUnavailable("etcd is down")
+	})
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, err := v.DescendantsOf(context.Background(), refOf(deployment), DeploymentDescendantKinds...)
+	if err == nil || !strings.Contains(err.Error(), "etcd is down") {
+		t.Errorf("expected the pod list to fail, got: %v", err)
+	}
+}
+
+func TestDescendantsOf(t *testing.T) {
+	nodeGVK := schema.GroupVersionKind{Version: "v1", Kind: "Node"}
+	mapper := newTestMapper()
+	mapper.Add(nodeGVK, meta.RESTScopeRoot)
+
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs1 := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	rs2 := newMeta(replicaSetGVK, "default", "app-2", deployment)
+	pod1a := newMeta(podGVK, "default", "app-1-a", rs1)
+	pod1b := newMeta(podGVK, "default", "app-1-b", rs1)
+	pod2a := newMeta(podGVK, "default", "app-2-a", rs2)
+
+	// The kubelet creates a mirror pod for each static pod, owned by its
+	// Node, in whichever namespace the static pod names.
+	node := newMeta(nodeGVK, "", "node-1")
+	mirrorPod := newMeta(podGVK, "kube-system", "kube-apiserver-node-1", node)
+	otherPod := newMeta(podGVK, "default", "etcd-node-1", node)
+
+	objs := []runtime.Object{deployment, rs1, rs2, pod1a, pod1b, pod2a, node, mirrorPod, otherPod}
+
+	tests := []struct {
+		name  string
+		ref   v1.ObjectReference
+		kinds []schema.GroupVersionKind
+		want  string
+	}{
+		{
+			name:  "several levels deep",
+			ref:   refOf(deployment),
+			kinds: DeploymentDescendantKinds,
+			want: `Deployment:app
+  ReplicaSet:app-1
+    Pod:app-1-a
+    Pod:app-1-b
+  ReplicaSet:app-2
+    Pod:app-2-a`,
+		},
+		{
+			name:  "only the kinds asked for",
+			ref:   refOf(deployment),
+			kinds: []schema.GroupVersionKind{replicaSetGVK},
+			want: `Deployment:app
+  ReplicaSet:app-1
+  ReplicaSet:app-2`,
+		},
+		{
+			name:  "from the middle",
+			ref:   refOf(rs1),
+			kinds: DeploymentDescendantKinds,
+			want: `ReplicaSet:app-1
+  Pod:app-1-a
+  Pod:app-1-b`,
+		},
+		{
+			name:  "no dependents",
+			ref:   refOf(pod2a),
+			kinds: DeploymentDescendantKinds,
+			want:  `Pod:app-2-a`,
+		},
+		{
+			name:  "cluster-scoped owner",
+			ref:   refOf(node),
+			kinds: []schema.GroupVersionKind{podGVK},
+			want: `Node:node-1
+  Pod:etcd-node-1
+  Pod:kube-apiserver-node-1`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestOwnerFetcher(t, mapper, objs...)
+
+			tree, err := v.DescendantsOf(lookupCtx(t), test.ref, test.kinds...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree.String() != test.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.want, tree)
+			}
+		})
+	}
+}
+
+func TestDescendantsOfFindsCachedKinds(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	v := newTestOwnerFetcher(t, newTestMapper(), deployment, rs, pod)
+
+	// Pods aren't fetched yet, so asking for ReplicaSets alone stops there.
+	tree, err := v.DescendantsOf(lookupCtx(t), refOf(deployment), replicaSetGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.ContainsUID(pod.UID) {
+		t.Errorf("expected no pods before they're fetched, got:\n%s", tree)
+	}
+
+	// Once another query has fetched them, the same query finds them.
+	if _, err := v.DescendantsOf(lookupCtx(t), refOf(rs), podGVK); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = v.DescendantsOf(lookupCtx(t), refOf(deployment), replicaSetGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.ContainsUID(pod.UID) {
+		t.Errorf("expected the cached pod, got:\n%s", tree)
+	}
+}
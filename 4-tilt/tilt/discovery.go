@@ -0,0 +1,107 @@
+package tilt
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// How often we reset the discovery cache to look for kinds we didn't know
+// about. Discovery lists every API group, so it's expensive.
+const minDiscoveryResetInterval = 10 * time.Second
+
+// A RESTMapper that caches discovery, e.g., a DeferredDiscoveryRESTMapper.
+type resettableMapper interface {
+	Reset()
+}
+
+// Looks up the resource for a kind.
+//
+// The DeferredDiscoveryRESTMapper only rediscovers when its cache is empty,
+// so it never finds CRDs installed after we started, e.g., Argo Rollouts
+// or Knative. If a kind is unknown, we reset the cache and try again.
+func (v *OwnerFetcher) restMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := v.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err == nil || !meta.IsNoMatchError(err) {
+		return mapping, err
+	}
+
+	resetter, ok := v.restMapper.(resettableMapper)
+	if !ok {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	if time.Since(v.lastDiscoveryReset) < minDiscoveryResetInterval {
+		v.mu.Unlock()
+		return nil, err
+	}
+	v.lastDiscoveryReset = time.Now()
+	v.mu.Unlock()
+
+	resetter.Reset()
+	return v.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+func hasUnknownKind(tree ObjectRefTree) bool {
+	found := false
+	tree.Walk(func(t ObjectRefTree, depth int) bool {
+		found = found || t.UnknownKind
+		return !found
+	})
+	return found
+}
+
+// ResolveKind looks up the kind of a resource name, e.g., "pods" or
+// "replicasets.apps".
+func (v *OwnerFetcher) ResolveKind(resource string) (schema.GroupVersionKind, error) {
+	return v.restMapper.KindFor(schema.ParseGroupResource(resource).WithVersion(""))
+}
+
+// ResolveRef looks up an object by a resource name and its name, e.g.,
+// "deployment" or "deployments.apps" and "my-busybox". The namespace is
+// ignored for cluster-scoped resources.
+func (v *OwnerFetcher) ResolveRef(ctx context.Context, resource, namespace, name string) (v1.ObjectReference, error) {
+	gvk, err := v.ResolveKind(resource)
+	if err != nil {
+		return v1.ObjectReference{}, err
+	}
+
+	mapping, err := v.restMapping(gvk)
+	if err != nil {
+		return v1.ObjectReference{}, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		namespace = ""
+	}
+
+	obj, err := v.metadata.Resource(mapping.Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return v1.ObjectReference{}, err
+	}
+
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	return v1.ObjectReference{
+		Name:       obj.Name,
+		Namespace:  obj.Namespace,
+		Kind:       kind,
+		UID:        obj.UID,
+		APIVersion: apiVersion,
+	}, nil
+}
+
+// Reports whether err means the cluster doesn't serve a kind, even if it's
+// wrapped.
+func isUnknownKind(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if meta.IsNoMatchError(err) {
+			return true
+		}
+	}
+	return false
+}
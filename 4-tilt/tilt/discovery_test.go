@@ -0,0 +1,153 @@
+package tilt
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var rolloutGVK = schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+
+// A RESTMapper that only learns about kinds installed after we started when
+// it's reset, like a DeferredDiscoveryRESTMapper.
+type discoveringMapper struct {
+	*meta.DefaultRESTMapper
+
+	mu        sync.Mutex
+	installed []schema.GroupVersionKind
+	resets    int
+}
+
+func (m *discoveringMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.DefaultRESTMapper.KindFor(resource)
+}
+
+func (m *discoveringMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.DefaultRESTMapper.RESTMapping(gk, versions...)
+}
+
+func (m *discoveringMapper) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resets++
+	for _, gvk := range m.installed {
+		m.DefaultRESTMapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+}
+
+// Installs a CRD, which the mapper finds the next time it's reset.
+func (m *discoveringMapper) install(gvk schema.GroupVersionKind) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.installed = append(m.installed, gvk)
+}
+
+func (m *discoveringMapper) resetCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resets
+}
+
+func TestOwnerTreeOfFindsCRDsInstalledLater(t *testing.T) {
+	rollout := newMeta(rolloutGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", rollout)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+	mapper := &discoveringMapper{DefaultRESTMapper: newTestMapper()}
+	v := newTestOwnerFetcher(t, mapper, rollout, rs, pod)
+
+	// Before the CRD is installed, we stop at a ref-only node.
+	tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasUnknownKind(tree) || !tree.Owners[0].Owners[0].UnknownKind {
+		t.Fatalf("expected the Rollout to be an unknown kind, got:\n%s", tree)
+	}
+	if tree.Owners[0].Owners[0].Ref.Name != rollout.Name {
+		t.Errorf("expected the unknown node to keep the Rollout's ref, got %v", tree.Owners[0].Owners[0].Ref)
+	}
+	if mapper.resetCount() != 1 {
+		t.Errorf("expected one discovery reset, got %d", mapper.resetCount())
+	}
+
+	// Right after installing it, we don't reset discovery again yet.
+	mapper.install(rolloutGVK)
+	tree, err = v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasUnknownKind(tree) {
+		t.Errorf("expected the Rollout to be unknown until the next reset, got:\n%s", tree)
+	}
+	if mapper.resetCount() != 1 {
+		t.Errorf("expected resets to be rate limited, got %d", mapper.resetCount())
+	}
+
+	// Once the rate limit passes, we find it.
+	v.mu.Lock()
+	v.lastDiscoveryReset = time.Now().Add(-minDiscoveryResetInterval)
+	v.mu.Unlock()
+	tree, err = v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasUnknownKind(tree) {
+		t.Errorf("expected the Rollout to be found, got:\n%s", tree)
+	}
+	if mapper.resetCount() != 2 {
+		t.Errorf("expected a second discovery reset, got %d", mapper.resetCount())
+	}
+}
+
+func TestOwnerTreeOfStopsAtKindsThatNeverResolve(t *testing.T) {
+	rollout := newMeta(rolloutGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", rollout)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+	mapper := &discoveringMapper{DefaultRESTMapper: newTestMapper()}
+	v := newTestOwnerFetcher(t, mapper, rollout, rs, pod)
+
+	for i := 0; i < 3; i++ {
+		tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner := tree.Owners[0].Owners[0]
+		if !owner.UnknownKind || owner.Ref.UID != rollout.UID || len(owner.Owners) != 0 {
+			t.Fatalf("expected a ref-only Rollout, got:\n%s", tree)
+		}
+	}
+	if mapper.resetCount() != 1 {
+		t.Errorf("expected one discovery reset, got %d", mapper.resetCount())
+	}
+}
+
+func TestFetchErrorsKeepUnknownKinds(t *testing.T) {
+	v := newTestOwnerFetcher(t, newTestMapper())
+	err := v.ensureResourceFetched(lookupCtx(t), rolloutGVK, "default")
+	if err == nil {
+		t.Fatal("expected fetching an unknown kind to fail")
+	}
+	if !isUnknownKind(err) {
+		t.Errorf("expected an unknown kind error, got: %v", err)
+	}
+}
+
+func TestIsUnknownKind(t *testing.T) {
+	_, err := newTestMapper().RESTMapping(rolloutGVK.GroupKind(), rolloutGVK.Version)
+	if !isUnknownKind(err) {
+		t.Errorf("expected %v to be an unknown kind", err)
+	}
+	if isUnknownKind(context.Canceled) || isUnknownKind(nil) {
+		t.Error("expected other errors not to be unknown kinds")
+	}
+}
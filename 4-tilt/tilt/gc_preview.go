@@ -0,0 +1,304 @@
+package tilt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// What the garbage collector does to an object when its owner is deleted.
+type GCAction string
+
+const (
+	// The object is deleted along with its owner.
+	GCDelete GCAction = "delete"
+
+	// The owner reference is removed, and the object stays.
+	GCOrphan GCAction = "orphan"
+
+	// The object has another owner that isn't being deleted, so only the
+	// owner reference to the deleted owner is removed.
+	GCKeep GCAction = "keep"
+)
+
+// The DeletionPropagation policies, in the order we preview them.
+var GCPolicies = []metav1.DeletionPropagation{
+	metav1.DeletePropagationForeground,
+	metav1.DeletePropagationBackground,
+	metav1.DeletePropagationOrphan,
+}
+
+// A GCPreview is what the garbage collector would do to an object and its
+// dependents if the object were deleted with a propagation policy.
+type GCPreview struct {
+	Policy metav1.DeletionPropagation `json:"policy"`
+	Root   GCNode                     `json:"root"`
+}
+
+type GCNode struct {
+	Ref    v1.ObjectReference `json:"ref"`
+	Action GCAction           `json:"action"`
+
+	// With foreground deletion, whether the owner waits for this object to
+	// be deleted first, i.e., its owner reference has blockOwnerDeletion.
+	BlocksOwner bool `json:"blocksOwner,omitempty"`
+
+	// The owners that keep the object alive, for GCKeep.
+	OtherOwners []v1.ObjectReference `json:"otherOwners,omitempty"`
+
+	Dependents []GCNode `json:"dependents,omitempty"`
+}
+
+// Deleted lists every object the garbage collector would delete, including
+// the object itself.
+func (p GCPreview) Deleted() []v1.ObjectReference {
+	result := []v1.ObjectReference{}
+	var walk func(n GCNode)
+	walk = func(n GCNode) {
+		if n.Action == GCDelete {
+			result = append(result, n.Ref)
+		}
+		for _, d := range n.Dependents {
+			walk(d)
+		}
+	}
+	walk(p.Root)
+	return result
+}
+
+func (n GCNode) note(policy metav1.DeletionPropagation) string {
+	switch {
+	case n.Action == GCKeep:
+		owners := []string{}
+		for _, owner := range n.OtherOwners {
+			owners = append(owners, fmt.Sprintf("%s:%s", owner.Kind, owner.Name))
+		}
+		return fmt.Sprintf("keep, also owned by %s", strings.Join(owners, ", "))
+	case n.Action == GCDelete && policy == metav1.DeletePropagationForeground && n.hasBlockingDependents():
+		return "delete after blocking dependents"
+	default:
+		return string(n.Action)
+	}
+}
+
+func (n GCNode) hasBlockingDependents() bool {
+	for _, dependent := range n.Dependents {
+		if dependent.BlocksOwner {
+			return true
+		}
+	}
+	return false
+}
+
+func (n GCNode) stringLines(policy metav1.DeletionPropagation) []string {
+	line := fmt.Sprintf("%s:%s (%s)", n.Ref.Kind, n.Ref.Name, n.note(policy))
+	if n.BlocksOwner {
+		line += " [blocks owner]"
+	}
+	result := []string{line}
+	for _, dependent := range n.Dependents {
+		// indent each of the dependents by two spaces
+		for _, branchLine := range dependent.stringLines(policy) {
+			result = append(result, fmt.Sprintf("  %s", branchLine))
+		}
+	}
+	return result
+}
+
+func (p GCPreview) String() string {
+	return strings.Join(p.Root.stringLines(p.Policy), "\n")
+}
+
+// DOT renders the preview as a Graphviz graph, with each object labeled
+// with what happens to it.
+func (p GCPreview) DOT() string {
+	return p.graph().dot()
+}
+
+// Mermaid renders the preview as a Mermaid flowchart, with each object
+// labeled with what happens to it.
+func (p GCPreview) Mermaid() string {
+	return p.graph().mermaid()
+}
+
+func (p GCPreview) graph() *refGraph {
+	g := newRefGraph()
+	var add func(n GCNode) int
+	add = func(n GCNode) int {
+		id := g.node(n.Ref)
+		g.annotate(id, n.note(p.Policy))
+		for _, dependent := range n.Dependents {
+			g.edge(id, add(dependent))
+		}
+		return id
+	}
+	add(p.Root)
+	return g
+}
+
+// GCPreview works out what the garbage collector would do if ref were
+// deleted with the given propagation policy, from the batch cache.
+//
+// Like DescendantsOf, we fetch the given kinds in ref's namespace first, and
+// only find dependents of other kinds if something else fetched them.
+//
+// A dependent is deleted only if all of its owners are deleted. Owners we
+// don't have cached count as alive, so the preview errs on the side of
+// keeping objects.
+func (v *OwnerFetcher) GCPreview(ctx context.Context, ref v1.ObjectReference, policy metav1.DeletionPropagation,
+	kinds ...schema.GroupVersionKind) (GCPreview, error) {
+	if ref.UID == "" {
+		return GCPreview{}, fmt.Errorf("Can only preview deletion of deployed entities")
+	}
+	switch policy {
+	case metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan:
+	default:
+		return GCPreview{}, fmt.Errorf("Unknown propagation policy %q", policy)
+	}
+
+	for _, gvk := range kinds {
+		err := v.ensureResourceFetched(ctx, gvk, ref.Namespace)
+		if err != nil {
+			return GCPreview{}, err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	deleted := map[types.UID]bool{ref.UID: true}
+	if policy != metav1.DeletePropagationOrphan {
+		v.collectDeleted(ref.UID, deleted)
+	}
+
+	root := GCNode{Ref: ref, Action: GCDelete}
+	visited := map[types.UID]bool{ref.UID: true}
+	root.Dependents = v.gcDependents(ref.UID, policy, deleted, visited)
+	return GCPreview{Policy: policy, Root: root}, nil
+}
+
+// Finds every descendant of uid whose owners are all deleted, until there
+// are no more. An object with two owners may only be deleted once both are.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) collectDeleted(uid types.UID, deleted map[types.UID]bool) {
+	candidates := []types.UID{}
+	seen := map[types.UID]bool{uid: true}
+	queue := []types.UID{uid}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for dependent := range v.dependents[next] {
+			if !seen[dependent] {
+				seen[dependent] = true
+				candidates = append(candidates, dependent)
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, candidate := range candidates {
+			if deleted[candidate] {
+				continue
+			}
+			cached, ok := v.metaCache[candidate]
+			if ok && len(v.liveOwners(cached.meta, deleted)) == 0 {
+				deleted[candidate] = true
+				changed = true
+			}
+		}
+	}
+}
+
+// The owners of an object that aren't deleted.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) liveOwners(meta *metav1.ObjectMeta, deleted map[types.UID]bool) []v1.ObjectReference {
+	result := []v1.ObjectReference{}
+	for _, owner := range meta.GetOwnerReferences() {
+		if !deleted[owner.UID] {
+			result = append(result, v1.ObjectReference{
+				Name:       owner.Name,
+				Kind:       owner.Kind,
+				UID:        owner.UID,
+				APIVersion: owner.APIVersion,
+			})
+		}
+	}
+	return result
+}
+
+// Dependents are visited in order of kind, name, and UID, so an object with
+// several deleted owners always shows up under the same one.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) gcDependents(uid types.UID, policy metav1.DeletionPropagation,
+	deleted, visited map[types.UID]bool) []GCNode {
+	result := []GCNode{}
+	for _, ref := range v.sortedDependents(uid) {
+		dependent := ref.UID
+
+		// An object with two deleted owners only shows up under the first.
+		if visited[dependent] {
+			continue
+		}
+		visited[dependent] = true
+
+		meta := v.metaCache[dependent].meta
+		node := GCNode{Ref: ref}
+		switch {
+		case policy == metav1.DeletePropagationOrphan:
+			node.Action = GCOrphan
+		case deleted[dependent]:
+			node.Action = GCDelete
+			node.BlocksOwner = policy == metav1.DeletePropagationForeground && blocksOwnerDeletion(meta, uid)
+			node.Dependents = v.gcDependents(dependent, policy, deleted, visited)
+		default:
+			node.Action = GCKeep
+			node.OtherOwners = v.liveOwners(meta, deleted)
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+// The cached dependents of uid, sorted by kind, name, and UID.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) sortedDependents(uid types.UID) []v1.ObjectReference {
+	result := []v1.ObjectReference{}
+	for dependent := range v.dependents[uid] {
+		ref, ok := v.cachedRef(dependent)
+		if ok {
+			result = append(result, ref)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.UID < b.UID
+	})
+	return result
+}
+
+func blocksOwnerDeletion(meta *metav1.ObjectMeta, owner types.UID) bool {
+	for _, ref := range meta.GetOwnerReferences() {
+		if ref.UID == owner {
+			return ref.BlockOwnerDeletion != nil && *ref.BlockOwnerDeletion
+		}
+	}
+	return false
+}
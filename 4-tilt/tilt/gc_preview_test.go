@@ -0,0 +1,123 @@
+package tilt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// A pod owned by two ReplicaSets of the same Deployment is deleted with
+// both, and always shows up under the first by name.
+func TestGCPreviewIsDeterministic(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rsA := newMeta(replicaSetGVK, "default", "app-a", deployment)
+	rsB := newMeta(replicaSetGVK, "default", "app-b", deployment)
+	pod := newMeta(podGVK, "default", "app-pod", rsB, rsA)
+	kinds := []schema.GroupVersionKind{replicaSetGVK, podGVK}
+
+	for i := 0; i < 20; i++ {
+		v := newTestOwnerFetcher(t, newTestMapper(), deployment, rsA, rsB, pod)
+		preview, err := v.GCPreview(lookupCtx(t), refOf(deployment), metav1.DeletePropagationBackground, kinds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rses := preview.Root.Dependents
+		if len(rses) != 2 || rses[0].Ref.Name != rsA.Name || rses[1].Ref.Name != rsB.Name {
+			t.Fatalf("expected %s and %s, got %+v", rsA.Name, rsB.Name, rses)
+		}
+		if len(rses[0].Dependents) != 1 || rses[0].Dependents[0].Ref.UID != pod.UID {
+			t.Fatalf("expected %s under %s, got %+v", pod.Name, rsA.Name, rses[0].Dependents)
+		}
+		if len(rses[1].Dependents) != 0 {
+			t.Fatalf("expected nothing under %s, got %+v", rsB.Name, rses[1].Dependents)
+		}
+		if rses[0].Dependents[0].Action != GCDelete {
+			t.Errorf("expected %s to be deleted, got %s", pod.Name, rses[0].Dependents[0].Action)
+		}
+	}
+}
+
+func TestGCPreviewPolicies(t *testing.T) {
+	yes := true
+	deployment := newMeta(deploymentGVK, "default", "app")
+	other := newMeta(deploymentGVK, "default", "other")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	rs.OwnerReferences[0].BlockOwnerDeletion = &yes
+	blocking := newMeta(podGVK, "default", "app-1-a", rs)
+	blocking.OwnerReferences[0].BlockOwnerDeletion = &yes
+	nonBlocking := newMeta(podGVK, "default", "app-1-b", rs)
+
+	// Owned by the ReplicaSet and by a Deployment we aren't deleting.
+	shared := newMeta(podGVK, "default", "shared", rs, other)
+
+	kinds := []schema.GroupVersionKind{replicaSetGVK, podGVK}
+
+	tests := []struct {
+		policy  metav1.DeletionPropagation
+		want    string
+		deleted []string
+	}{
+		{
+			policy: metav1.DeletePropagationForeground,
+			want: `Deployment:app (delete after blocking dependents)
+  ReplicaSet:app-1 (delete after blocking dependents) [blocks owner]
+    Pod:app-1-a (delete) [blocks owner]
+    Pod:app-1-b (delete)
+    Pod:shared (keep, also owned by Deployment:other)`,
+			deleted: []string{"Deployment:app", "ReplicaSet:app-1", "Pod:app-1-a", "Pod:app-1-b"},
+		},
+		{
+			// The same objects go, but nothing waits for its dependents.
+			policy: metav1.DeletePropagationBackground,
+			want: `Deployment:app (delete)
+  ReplicaSet:app-1 (delete)
+    Pod:app-1-a (delete)
+    Pod:app-1-b (delete)
+    Pod:shared (keep, also owned by Deployment:other)`,
+			deleted: []string{"Deployment:app", "ReplicaSet:app-1", "Pod:app-1-a", "Pod:app-1-b"},
+		},
+		{
+			// The ReplicaSet keeps its pods, so there's nothing below it.
+			policy: metav1.DeletePropagationOrphan,
+			want: `Deployment:app (delete)
+  ReplicaSet:app-1 (orphan)`,
+			deleted: []string{"Deployment:app"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(string(test.policy), func(t *testing.T) {
+			v := newTestOwnerFetcher(t, newTestMapper(), deployment, other, rs, blocking, nonBlocking, shared)
+
+			preview, err := v.GCPreview(lookupCtx(t), refOf(deployment), test.policy, kinds...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.String() != test.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.want, preview)
+			}
+
+			deleted := []string{}
+			for _, ref := range preview.Deleted() {
+				deleted = append(deleted, ref.Kind+":"+ref.Name)
+			}
+			if !reflect.DeepEqual(deleted, test.deleted) {
+				t.Errorf("expected to delete %v, got %v", test.deleted, deleted)
+			}
+		})
+	}
+}
+
+func TestGCPreviewRejectsUnknownPolicies(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	v := newTestOwnerFetcher(t, newTestMapper(), deployment)
+
+	_, err := v.GCPreview(lookupCtx(t), refOf(deployment), "Sideways")
+	if err == nil || !strings.Contains(err.Error(), "Sideways") {
+		t.Errorf("expected an unknown policy error, got: %v", err)
+	}
+}
@@ -0,0 +1,503 @@
+package tilt
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// How long to wait before retrying a failed list or watch. Each failure in
+// a row doubles the wait, up to maxRetryInterval.
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+// How many objects to list at a time, unless CacheOptions says otherwise.
+// The same default as the client-go pager.
+const defaultPageSize = 500
+
+// CacheOptions bound how much the batch cache lists and keeps.
+type CacheOptions struct {
+	// How many objects to list per request. Zero uses defaultPageSize.
+	PageSize int64
+
+	// Only cache objects that match these selectors, e.g., "app=my-busybox".
+	// Owners outside the selectors are fetched one at a time, and their
+	// dependents can't be found.
+	//
+	// The informer backend ignores these. Scope the informer factory instead.
+	LabelSelector string
+	FieldSelector string
+
+	// The most objects to keep, evicting the least recently used. Evicted
+	// objects are fetched one at a time if we need them again, and their
+	// dependents can't be found until the watch sees them change. Zero means
+	// no limit.
+	MaxObjects int
+}
+
+// WithCacheOptions configures the batch cache. Call it before the first lookup.
+func (v *OwnerFetcher) WithCacheOptions(opts CacheOptions) *OwnerFetcher {
+	v.cacheOpts = opts
+	return v
+}
+
+// An object's metadata in the batch cache, along with its kind, which the
+// metadata API doesn't return.
+type cachedMeta struct {
+	gvk  schema.GroupVersionKind
+	meta *metav1.ObjectMeta
+
+	// The object's place in the LRU list.
+	elem *list.Element
+}
+
+// Keeps only the metadata we need to build trees. Managed fields and
+// annotations like kubectl's last-applied-configuration are often most of
+// an object's metadata.
+func trimMeta(meta *metav1.ObjectMeta) *metav1.ObjectMeta {
+	return &metav1.ObjectMeta{
+		Name:            meta.Name,
+		Namespace:       meta.Namespace,
+		UID:             meta.UID,
+		ResourceVersion: meta.ResourceVersion,
+		OwnerReferences: meta.OwnerReferences,
+	}
+}
+
+type ResourceState string
+
+const (
+	// The first list is in progress.
+	ResourceFetching ResourceState = "Fetching"
+
+	// Listed, and the watch is keeping the cache up to date.
+	ResourceCached ResourceState = "Cached"
+
+	// Listed, but the watch failed, so the cache may be out of date until
+	// the watch recovers.
+	ResourceStale ResourceState = "Stale"
+
+	// The list failed, so lookups fail until a retry succeeds.
+	ResourceFailing ResourceState = "Failing"
+
+	// The list failed, and we're trying it again.
+	ResourceRetrying ResourceState = "Retrying"
+
+	// Loaded from a snapshot, and the watch is catching up from the
+	// snapshot's resourceVersion.
+	ResourceRestored ResourceState = "Restored"
+)
+
+// The health of the batch cache for one kind in one namespace.
+type ResourceStatus struct {
+	GVK       schema.GroupVersionKind
+	Namespace string
+	State     ResourceState
+
+	// The last time we listed every object.
+	LastSync time.Time
+
+	// The most recent error, and how many times in a row we've failed.
+	// Cleared when a list or watch succeeds.
+	Err      error
+	Failures int
+
+	// When we'll try again, if we're failing.
+	RetryAt time.Time
+}
+
+func (s ResourceStatus) String() string {
+	name := s.GVK.Kind
+	if s.Namespace != "" {
+		name = fmt.Sprintf("%s in namespace %s", name, s.Namespace)
+	}
+	if s.Err != nil {
+		return fmt.Sprintf("%s: %s (%d failures, retrying in %s): %v", name, s.State, s.Failures,
+			time.Until(s.RetryAt).Round(time.Second), s.Err)
+	}
+	return fmt.Sprintf("%s: %s", name, s.State)
+}
+
+// The batch cache for one kind in one namespace.
+type resourceFetch struct {
+	gvr    schema.GroupVersionResource
+	status ResourceStatus
+
+	// Closed when the current list attempt finishes, or when a restored
+	// watch first opens or fails. nil when there isn't one.
+	attempt chan struct{}
+
+	// The last resourceVersion we saw, to save in snapshots.
+	resourceVersion string
+
+	// With the informer backend, the shared informer that fills the cache
+	// instead of our own list and watch.
+	informer cache.SharedIndexInformer
+}
+
+// Must hold the lock.
+func (f *resourceFetch) fail(err error) {
+	f.status.Err = err
+	f.status.Failures++
+	backoff := minRetryInterval << uint(f.status.Failures-1)
+	if backoff > maxRetryInterval || backoff <= 0 {
+		backoff = maxRetryInterval
+	}
+	f.status.RetryAt = time.Now().Add(backoff)
+}
+
+// Must hold the lock.
+func (f *resourceFetch) succeed() {
+	f.status.State = ResourceCached
+	f.status.Err = nil
+	f.status.Failures = 0
+	f.status.RetryAt = time.Time{}
+}
+
+// Lets callers waiting on a restored fetch know that the watch has either
+// caught up or failed.
+//
+// Must hold the lock.
+func (f *resourceFetch) endRestore() {
+	if f.status.State != ResourceRestored && f.attempt != nil {
+		close(f.attempt)
+		f.attempt = nil
+	}
+}
+
+// Status reports the health of the batch cache for every kind and namespace
+// we've needed so far.
+func (v *OwnerFetcher) Status() []ResourceStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	result := []ResourceStatus{}
+	for _, fetch := range v.resourceFetches {
+		result = append(result, fetch.status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].GVK.String() < result[j].GVK.String()
+	})
+	return result
+}
+
+// As an optimization, we batch fetch all the ObjectMetas of a resource type
+// the first time we need that resource, then watch updates.
+//
+// If the fetch fails, we return the error, and don't try again until the
+// backoff expires. Once the fetch succeeds, we keep using the cache even if
+// it goes stale.
+func (v *OwnerFetcher) ensureResourceFetched(ctx context.Context, gvk schema.GroupVersionKind, ns string) error {
+	if v.informers != nil {
+		return v.ensureInformerSynced(ctx, gvk)
+	}
+
+	rns := resourceNamespace{Namespace: ns, GVK: gvk}
+	for {
+		v.mu.Lock()
+		if v.closed {
+			v.mu.Unlock()
+			return ErrClosed
+		}
+
+		fetch, ok := v.resourceFetches[rns]
+		if !ok {
+			fetch = &resourceFetch{status: ResourceStatus{GVK: gvk, Namespace: ns, State: ResourceFetching}}
+			v.resourceFetches[rns] = fetch
+		}
+
+		if fetch.status.State == ResourceCached || fetch.status.State == ResourceStale {
+			v.mu.Unlock()
+			return nil
+		}
+
+		if fetch.attempt != nil {
+			attempt := fetch.attempt
+			v.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-attempt:
+			}
+			continue
+		}
+
+		if fetch.status.Err != nil && time.Now().Before(fetch.status.RetryAt) {
+			err := fetch.status.Err
+			v.mu.Unlock()
+			return err
+		}
+
+		// The list runs in the background, so that every caller can give up
+		// when its ctx is done, including this one.
+		if fetch.status.Err != nil {
+			fetch.status.State = ResourceRetrying
+		}
+		fetch.attempt = make(chan struct{})
+		v.spawn(func() { v.fetchResource(fetch) })
+		v.mu.Unlock()
+	}
+}
+
+// Makes one attempt at the first list, then starts watching if it worked.
+func (v *OwnerFetcher) fetchResource(fetch *resourceFetch) {
+	rv, err := v.firstList(fetch)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	close(fetch.attempt)
+	fetch.attempt = nil
+	if err != nil {
+		fetch.status.State = ResourceFailing
+		fetch.fail(err)
+		return
+	}
+	fetch.succeed()
+	v.spawn(func() { v.watchResource(fetch, rv) })
+}
+
+func (v *OwnerFetcher) firstList(fetch *resourceFetch) (string, error) {
+	gvk := fetch.status.GVK
+	mapping, err := v.restMapping(gvk)
+	if err != nil {
+		return "", fmt.Errorf("mapping %s: %w", gvk, err)
+	}
+	fetch.gvr = mapping.Resource
+
+	rv, err := v.relist(fetch)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s metadata: %v", gvk.Kind, err)
+	}
+	return rv, nil
+}
+
+// Keeps the batch cache in sync, like a client-go Reflector.
+//
+// The API server closes watches routinely, so when a watch closes, we
+// re-open it from the last resourceVersion we saw. If that resourceVersion
+// has expired, we relist.
+func (v *OwnerFetcher) watchResource(fetch *resourceFetch, rv string) {
+	ctx := v.globalCtx
+	needsList := false
+	for ctx.Err() == nil {
+		var err error
+		if needsList {
+			rv, err = v.relist(fetch)
+			needsList = err != nil
+		} else {
+			rv, err = v.watchFrom(fetch, rv)
+			if errors.IsResourceExpired(err) || errors.IsGone(err) {
+				// Relist right away.
+				needsList = true
+				continue
+			}
+		}
+
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		v.mu.Lock()
+		fetch.status.State = ResourceStale
+		fetch.fail(err)
+		fetch.endRestore()
+		retryAt := fetch.status.RetryAt
+		v.mu.Unlock()
+
+		log.Printf("Error watching %s metadata: %v", fetch.status.GVK.Kind, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(retryAt)):
+		}
+	}
+}
+
+// Lists every object a page at a time, replacing whatever we had cached
+// before. Returns the resourceVersion to watch from.
+//
+// If the continue token expires between pages, we start over with a single
+// unpaginated list, like the client-go pager. Pages from the expired
+// snapshot are thrown away, so we only cache one consistent snapshot.
+func (v *OwnerFetcher) relist(fetch *resourceFetch) (string, error) {
+	gvk := fetch.status.GVK
+	ns := fetch.status.Namespace
+	opts := v.listOptions()
+	opts.Limit = v.cacheOpts.PageSize
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageSize
+	}
+
+	var items []*metav1.ObjectMeta
+	rv := ""
+	for {
+		metas, err := v.metadata.Resource(fetch.gvr).Namespace(ns).List(v.globalCtx, opts)
+		if errors.IsResourceExpired(err) && opts.Continue != "" {
+			opts.Limit = 0
+			opts.Continue = ""
+			items = nil
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// Keep only what we cache, so a big list doesn't hold on to every
+		// page in full.
+		for i := range metas.Items {
+			items = append(items, trimMeta(&metas.Items[i].ObjectMeta))
+		}
+
+		// Every page is from the same snapshot.
+		rv = metas.GetResourceVersion()
+		opts.Continue = metas.GetContinue()
+		if opts.Continue == "" {
+			break
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	listed := make(map[types.UID]bool, len(items))
+	for _, meta := range items {
+		listed[meta.GetUID()] = true
+		v.cacheMeta(gvk, meta)
+	}
+
+	// Anything that isn't in the list was deleted while we weren't watching.
+	for uid, cached := range v.metaCache {
+		inList := cached.gvk == gvk && (ns == "" || cached.meta.GetNamespace() == ns)
+		if inList && !listed[uid] {
+			v.forgetDeleted(uid)
+		}
+	}
+
+	fetch.status.LastSync = time.Now()
+	fetch.resourceVersion = rv
+	return rv, nil
+}
+
+// The selectors to list and watch with.
+func (v *OwnerFetcher) listOptions() metav1.ListOptions {
+	return metav1.ListOptions{
+		LabelSelector: v.cacheOpts.LabelSelector,
+		FieldSelector: v.cacheOpts.FieldSelector,
+	}
+}
+
+// Watches from a resourceVersion until the watch closes. Returns the last
+// resourceVersion we saw.
+func (v *OwnerFetcher) watchFrom(fetch *resourceFetch, rv string) (string, error) {
+	ctx := v.globalCtx
+	opts := v.listOptions()
+	opts.ResourceVersion = rv
+	opts.AllowWatchBookmarks = true
+	w, err := v.metadata.Resource(fetch.gvr).Namespace(fetch.status.Namespace).Watch(ctx, opts)
+	if err != nil {
+		return rv, err
+	}
+	defer w.Stop()
+
+	v.mu.Lock()
+	fetch.succeed()
+	fetch.endRestore()
+	v.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return rv, ctx.Err()
+
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return rv, nil
+			}
+
+			if event.Type == watch.Error {
+				return rv, errors.FromObject(event.Object)
+			}
+
+			m, ok := event.Object.(*metav1.PartialObjectMetadata)
+			if !ok {
+				continue
+			}
+			if m.GetResourceVersion() != "" {
+				rv = m.GetResourceVersion()
+			}
+
+			v.mu.Lock()
+			fetch.resourceVersion = rv
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				v.cacheMeta(fetch.status.GVK, &m.ObjectMeta)
+			case watch.Deleted:
+				v.forgetDeleted(m.GetUID())
+			}
+			v.mu.Unlock()
+		}
+	}
+}
+
+// Adds an object to the batch cache, and updates the reverse index.
+// If the cache is full, evicts the least recently used object.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) cacheMeta(gvk schema.GroupVersionKind, meta *metav1.ObjectMeta) {
+	uid := meta.GetUID()
+	meta = trimMeta(meta)
+	v.uncacheMeta(uid)
+	v.checkSource(uid, meta)
+
+	v.metaCache[uid] = cachedMeta{gvk: gvk, meta: meta, elem: v.lru.PushFront(uid)}
+	for _, owner := range meta.GetOwnerReferences() {
+		dependents, ok := v.dependents[owner.UID]
+		if !ok {
+			dependents = make(map[types.UID]bool)
+			v.dependents[owner.UID] = dependents
+		}
+		dependents[uid] = true
+	}
+
+	for v.cacheOpts.MaxObjects > 0 && v.lru.Len() > v.cacheOpts.MaxObjects {
+		v.uncacheMeta(v.lru.Back().Value.(types.UID))
+	}
+}
+
+// Marks a cached object as recently used.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) touchMeta(cached cachedMeta) {
+	v.lru.MoveToFront(cached.elem)
+}
+
+// Removes an object from the batch cache and the reverse index.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) uncacheMeta(uid types.UID) {
+	old, ok := v.metaCache[uid]
+	if !ok {
+		return
+	}
+	for _, owner := range old.meta.GetOwnerReferences() {
+		delete(v.dependents[owner.UID], uid)
+		if len(v.dependents[owner.UID]) == 0 {
+			delete(v.dependents, owner.UID)
+		}
+	}
+	v.lru.Remove(old.elem)
+	delete(v.metaCache, uid)
+}
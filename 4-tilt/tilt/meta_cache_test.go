@@ -0,0 +1,537 @@
+package tilt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/metadata"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// A page of a metadata list, the way the fake's reactors return it.
+func listPage(rv, continueToken string, items ...*metav1.PartialObjectMetadata) *metav1.List {
+	list := &metav1.List{ListMeta: metav1.ListMeta{ResourceVersion: rv, Continue: continueToken}}
+	for _, item := range items {
+		list.Items = append(list.Items, runtime.RawExtension{Object: item})
+	}
+	return list
+}
+
+func TestRelistDropsPagesFromExpiredSnapshot(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	kept := newMeta(replicaSetGVK, "default", "kept", deployment)
+	deleted := newMeta(replicaSetGVK, "default", "deleted", deployment)
+	pod := newMeta(podGVK, "default", "pod", kept)
+
+	// The first page has an object that's deleted before the second page,
+	// and by then the continue token has expired.
+	client := newTestMetadataClient(deployment, kept, pod)
+	listCalls := 0
+	client.PrependReactor("list", "replicasets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// The fake's list actions don't keep the continue token, so go by
+		// the order of the calls.
+		listCalls++
+		switch listCalls {
+		case 1:
+			return true, listPage("1", "page-2", deleted), nil
+		case 2:
+			return true, nil, errors.NewResourceExpired("continue token expired")
+		}
+		return true, listPage("2", "", kept), nil
+	})
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if listCalls != 3 {
+		t.Errorf("expected a page, an expired page, and a full list, got %d lists", listCalls)
+	}
+	if _, ok := v.metaCache[deleted.UID]; ok {
+		t.Errorf("expected %s from the expired snapshot not to be cached", deleted.Name)
+	}
+	if _, ok := v.metaCache[kept.UID]; !ok {
+		t.Errorf("expected %s to be cached", kept.Name)
+	}
+	if v.dependents[deployment.UID][deleted.UID] {
+		t.Errorf("expected %s not to be a dependent of %s", deleted.Name, deployment.Name)
+	}
+}
+
+func TestCacheSendsSelectors(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	deployment.Labels = map[string]string{"app": "web"}
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	rs.Labels = map[string]string{"app": "web"}
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+	client := newTestMetadataClient(deployment, rs, pod)
+	var mu sync.Mutex
+	selectors := []string{}
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+		mu.Lock()
+		defer mu.Unlock()
+		selectors = append(selectors, fmt.Sprintf("list %s %s", restrictions.Labels, restrictions.Fields))
+		return false, nil, nil
+	})
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		restrictions := action.(k8stesting.WatchAction).GetWatchRestrictions()
+		mu.Lock()
+		defer mu.Unlock()
+		selectors = append(selectors, fmt.Sprintf("watch %s %s", restrictions.Labels, restrictions.Fields))
+		return false, nil, nil
+	})
+
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+	v.WithCacheOptions(CacheOptions{LabelSelector: "app=web", FieldSelector: "metadata.namespace=default"})
+	tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.ContainsUID(deployment.UID) {
+		t.Errorf("expected the tree to reach %s, got:\n%s", deployment.Name, tree)
+	}
+	waitForWatch(t, client, "deployments")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(selectors) == 0 {
+		t.Fatal("expected lists and watches")
+	}
+	for _, sent := range selectors {
+		if sent != "list app=web metadata.namespace=default" && sent != "watch app=web metadata.namespace=default" {
+			t.Errorf("expected every list and watch to send the selectors, got %q", sent)
+		}
+	}
+}
+
+func TestCacheEvictsBeyondMaxObjects(t *testing.T) {
+	// 60 owners, more than fit.
+	objs := []runtime.Object{}
+	pods := []*metav1.PartialObjectMetadata{}
+	for d := 0; d < 20; d++ {
+		deployment := newMeta(deploymentGVK, "default", fmt.Sprintf("app-%d", d))
+		objs = append(objs, deployment)
+		for r := 0; r < 2; r++ {
+			rs := newMeta(replicaSetGVK, "default", fmt.Sprintf("app-%d-%d", d, r), deployment)
+			pod := newMeta(podGVK, "default", fmt.Sprintf("app-%d-%d-a", d, r), rs)
+			objs = append(objs, rs, pod)
+			pods = append(pods, pod)
+		}
+	}
+	v := newTestOwnerFetcher(t, newTestMapper(), objs...)
+	v.WithCacheOptions(CacheOptions{MaxObjects: 25})
+
+	// Every lookup still finds the whole tree, fetching evicted owners one at
+	// a time.
+	for _, pod := range pods {
+		tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.Owners) != 1 || len(tree.Owners[0].Owners) != 1 {
+			t.Fatalf("expected a pod, ReplicaSet, and Deployment, got:\n%s", tree)
+		}
+
+		v.mu.Lock()
+		cached, lru := len(v.metaCache), v.lru.Len()
+		v.mu.Unlock()
+		if cached > 25 || lru > 25 {
+			t.Fatalf("expected at most 25 cached objects, got %d (%d in the LRU list)", cached, lru)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.metaCache) != 25 {
+		t.Errorf("expected the cache to fill up to 25 objects, got %d", len(v.metaCache))
+	}
+}
+
+// Hands the first watch on resource to the test, and lets later watches
+// through to the fake.
+func fakeFirstWatch(client *metadatafake.FakeMetadataClient, resource string) *watch.FakeWatcher {
+	fw := watch.NewFakeWithChanSize(10, false)
+	var watches int64
+	client.PrependWatchReactor(resource, func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if atomic.AddInt64(&watches, 1) == 1 {
+			return true, fw, nil
+		}
+		return false, nil, nil
+	})
+	return fw
+}
+
+func cached(v *OwnerFetcher, uid types.UID) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.metaCache[uid]
+	return ok
+}
+
+func TestWatchDeletesForgetObjects(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(deployment, rs, pod)
+	fw := fakeFirstWatch(client, "replicasets")
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached(v, rs.UID) {
+		t.Fatalf("expected %s to be cached", rs.Name)
+	}
+
+	fw.Delete(rs)
+	waitFor(t, "the ReplicaSet to be forgotten", func() bool {
+		return !cached(v, rs.UID)
+	})
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.dependents[deployment.UID][rs.UID] {
+		t.Errorf("expected %s not to be a dependent of %s", rs.Name, deployment.Name)
+	}
+}
+
+func TestExpiredWatchRelists(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  *errors.StatusError
+	}{
+		{"Expired", errors.NewResourceExpired("too old resource version")},
+		{"Gone", errors.NewGone("too old resource version")},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testExpiredWatchRelists(t, tc.err)
+		})
+	}
+}
+
+// Both are 410s. Watches send the first, and older servers the second.
+func testExpiredWatchRelists(t *testing.T, expired *errors.StatusError) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	kept := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	gone := newMeta(replicaSetGVK, "default", "app-2", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", kept)
+	client := newTestMetadataClient(deployment, kept, gone, pod)
+	fw := fakeFirstWatch(client, "replicasets")
+	var lists int64
+	client.PrependReactor("list", "replicasets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt64(&lists, 1)
+		return false, nil, nil
+	})
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached(v, gone.UID) {
+		t.Fatalf("expected %s to be cached", gone.Name)
+	}
+
+	// The ReplicaSet is deleted while the watch is down, and then the
+	// watch's resourceVersion expires, so we never see the delete.
+	err = client.Resource(replicaSetGVK.GroupVersion().WithResource("replicasets")).
+		Namespace("default").Delete(context.Background(), gone.Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Error(&expired.ErrStatus)
+
+	waitFor(t, "the relist to drop the deleted ReplicaSet", func() bool {
+		return !cached(v, gone.UID)
+	})
+	if n := atomic.LoadInt64(&lists); n != 2 {
+		t.Errorf("expected a list and a relist, got %d lists", n)
+	}
+	if !cached(v, kept.UID) {
+		t.Errorf("expected %s to still be cached", kept.Name)
+	}
+	waitFor(t, "the cache to be watching again", func() bool {
+		return statusOf(t, v, replicaSetGVK).State == ResourceCached
+	})
+}
+
+// The status of the batch cache for one kind.
+func statusOf(t *testing.T, v *OwnerFetcher, gvk schema.GroupVersionKind) ResourceStatus {
+	t.Helper()
+	for _, status := range v.Status() {
+		if status.GVK == gvk {
+			return status
+		}
+	}
+	t.Fatalf("expected a status for %s, got %v", gvk.Kind, v.Status())
+	return ResourceStatus{}
+}
+
+// Lets the next retry go now, instead of waiting out the backoff.
+func expireBackoff(v *OwnerFetcher) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, fetch := range v.resourceFetches {
+		fetch.status.RetryAt = time.Now()
+	}
+}
+
+func TestFailedListsRetryWithBackoff(t *testing.T) {
+	rs := newMeta(replicaSetGVK, "default", "app-1")
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(rs, pod)
+
+	// Fail twice, then hang until released, then succeed.
+	var lists int64
+	release := make(chan struct{})
+	client.PrependReactor("list", "replicasets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		switch atomic.AddInt64(&lists, 1) {
+		case 1, 2:
+			return true, nil, errors.NewServiceUnavailable("etcd is down")
+		case 3:
+			<-release
+		}
+		return false, nil, nil
+	})
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	// The first failure.
+	start := time.Now()
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err == nil || !strings.Contains(err.Error(), "etcd is down") {
+		t.Fatalf("expected the list to fail, got: %v", err)
+	}
+	status := statusOf(t, v, replicaSetGVK)
+	if status.State != ResourceFailing || status.Failures != 1 || status.Err == nil {
+		t.Fatalf("expected one failure, got %+v", status)
+	}
+	firstBackoff := status.RetryAt.Sub(start)
+	if firstBackoff < minRetryInterval || firstBackoff > 2*minRetryInterval {
+		t.Errorf("expected to back off about %s, got %s", minRetryInterval, firstBackoff)
+	}
+
+	// Lookups during the backoff fail without listing again.
+	_, err = v.OwnerTreeOf(lookupCtx(t), pod)
+	if err == nil {
+		t.Fatal("expected the lookup to fail during the backoff")
+	}
+	if n := atomic.LoadInt64(&lists); n != 1 {
+		t.Errorf("expected no list during the backoff, got %d lists", n)
+	}
+
+	// The second failure backs off longer.
+	expireBackoff(v)
+	start = time.Now()
+	_, err = v.OwnerTreeOf(lookupCtx(t), pod)
+	if err == nil {
+		t.Fatal("expected the retry to fail")
+	}
+	status = statusOf(t, v, replicaSetGVK)
+	if status.State != ResourceFailing || status.Failures != 2 {
+		t.Fatalf("expected two failures, got %+v", status)
+	}
+	if secondBackoff := status.RetryAt.Sub(start); secondBackoff <= firstBackoff {
+		t.Errorf("expected the backoff to grow from %s, got %s", firstBackoff, secondBackoff)
+	}
+
+	// The third attempt is retrying until the list returns, then synced.
+	expireBackoff(v)
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+		done <- err
+	}()
+	waitFor(t, "the retry to start", func() bool {
+		return statusOf(t, v, replicaSetGVK).State == ResourceRetrying
+	})
+	close(release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = statusOf(t, v, replicaSetGVK)
+	if status.State != ResourceCached || status.Failures != 0 || status.Err != nil || status.LastSync.IsZero() {
+		t.Errorf("expected a synced cache, got %+v", status)
+	}
+}
+
+// Counts every request to the fake, including watches.
+func countCalls(client *metadatafake.FakeMetadataClient, calls *int64) {
+	client.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt64(calls, 1)
+		return false, nil, nil
+	})
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		atomic.AddInt64(calls, 1)
+		return false, nil, nil
+	})
+}
+
+// About 10,000 objects: 500 Deployments, each with 2 ReplicaSets of 9 pods.
+func manyObjects() (objs []runtime.Object, pods []*metav1.PartialObjectMetadata) {
+	for d := 0; d < 500; d++ {
+		deployment := newMeta(deploymentGVK, "default", fmt.Sprintf("app-%d", d))
+		objs = append(objs, deployment)
+		for r := 0; r < 2; r++ {
+			rs := newMeta(replicaSetGVK, "default", fmt.Sprintf("app-%d-%d", d, r), deployment)
+			objs = append(objs, rs)
+			for p := 0; p < 9; p++ {
+				pod := newMeta(podGVK, "default", fmt.Sprintf("app-%d-%d-%d", d, r, p), rs)
+				objs = append(objs, pod)
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return objs, pods
+}
+
+// Pages lists by Limit and Continue, which the fake ignores. Continue
+// tokens are offsets into the full list.
+type pagingClient struct {
+	metadata.Interface
+	pages *int64
+}
+
+func (c pagingClient) Resource(gvr schema.GroupVersionResource) metadata.Getter {
+	return pagingGetter{Getter: c.Interface.Resource(gvr), pages: c.pages}
+}
+
+type pagingGetter struct {
+	metadata.Getter
+	pages *int64
+}
+
+func (g pagingGetter) Namespace(ns string) metadata.ResourceInterface {
+	return pagingResource{ResourceInterface: g.Getter.Namespace(ns), pages: g.pages}
+}
+
+type pagingResource struct {
+	metadata.ResourceInterface
+	pages *int64
+}
+
+func (r pagingResource) List(ctx context.Context, opts metav1.ListOptions) (*metav1.PartialObjectMetadataList, error) {
+	atomic.AddInt64(r.pages, 1)
+	offset := 0
+	if opts.Continue != "" {
+		var err error
+		offset, err = strconv.Atoi(opts.Continue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	limit := opts.Limit
+	opts.Limit, opts.Continue = 0, ""
+	list, err := r.ResourceInterface.List(ctx, opts)
+	if err != nil || limit == 0 {
+		return list, err
+	}
+
+	end := offset + int(limit)
+	if end < len(list.Items) {
+		list.Continue = strconv.Itoa(end)
+	} else {
+		end = len(list.Items)
+	}
+	list.Items = list.Items[offset:end]
+	return list, nil
+}
+
+// Looks up the owner tree of every pod in a cluster of about 10,000 objects,
+// with 1,500 owners listed 500 at a time. calls/op is how many requests it takes, pages/op how
+// many of those are list pages, and the allocations show how much memory the
+// batch cache costs.
+//
+// Cold starts with an empty cache. Bounded does too, but keeps at most 1,000
+// objects, so it fetches evicted owners one at a time. Warm looks up the
+// same pods again.
+func BenchmarkOwnerTreeOf(b *testing.B) {
+	objs, pods := manyObjects()
+	ctx := context.Background()
+
+	for _, bc := range []struct {
+		name string
+		opts CacheOptions
+	}{
+		{"Cold", CacheOptions{}},
+		{"Bounded", CacheOptions{MaxObjects: 1000}},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var calls, pages, cached int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				client := newTestMetadataClient(objs...)
+				countCalls(client, &calls)
+				v := NewOwnerFetcherForClients(ctx, newTestMapper(), pagingClient{client, &pages}).
+					WithCacheOptions(bc.opts)
+				b.StartTimer()
+
+				for _, pod := range pods {
+					_, err := v.OwnerTreeOf(ctx, pod)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+				v.mu.Lock()
+				cached += int64(len(v.metaCache))
+				v.mu.Unlock()
+				_ = v.Close()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&calls))/float64(b.N), "calls/op")
+			b.ReportMetric(float64(atomic.LoadInt64(&pages))/float64(b.N), "pages/op")
+			b.ReportMetric(float64(cached)/float64(b.N), "cached/op")
+		})
+	}
+
+	b.Run("Warm", func(b *testing.B) {
+		client := newTestMetadataClient(objs...)
+		var calls, pages int64
+		countCalls(client, &calls)
+		v := NewOwnerFetcherForClients(ctx, newTestMapper(), pagingClient{client, &pages})
+		defer v.Close()
+		for _, pod := range pods {
+			_, err := v.OwnerTreeOf(ctx, pod)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		atomic.StoreInt64(&calls, 0)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, pod := range pods {
+				_, err := v.OwnerTreeOf(ctx, pod)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&calls))/float64(b.N), "calls/op")
+	})
+}
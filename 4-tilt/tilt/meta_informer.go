@@ -0,0 +1,162 @@
+package tilt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NewOwnerFetcherForInformers creates an OwnerFetcher that fills its batch
+// cache from a shared metadata informer factory, instead of listing and
+// watching on its own. The informers are shared with anything else that
+// uses the factory, and take care of resyncs and missed deletes.
+//
+// The OwnerFetcher starts the informers it needs, and they run until ctx is
+// done, even after the OwnerFetcher is closed, because anything else using
+// the factory may need them. The factory can't remove event handlers, so
+// ours ignore events after Close. If the factory only watches one
+// namespace, owners in other namespaces are fetched one at a time with the
+// metadata client.
+func NewOwnerFetcherForInformers(ctx context.Context, mapper meta.RESTMapper, metaClient metadata.Interface,
+	informers metadatainformer.SharedInformerFactory) *OwnerFetcher {
+	v := NewOwnerFetcherForClients(ctx, mapper, metaClient)
+	v.informers = informers
+	v.informerStop = ctx.Done()
+	return v
+}
+
+// The informer version of ensureResourceFetched. Informers retry on their
+// own, so we wait until the first list succeeds or ctx is done.
+//
+// There's one informer per kind, for whatever namespaces the factory
+// watches, so the status has no namespace.
+func (v *OwnerFetcher) ensureInformerSynced(ctx context.Context, gvk schema.GroupVersionKind) error {
+	rns := resourceNamespace{GVK: gvk}
+	v.mu.Lock()
+	if v.closed {
+		v.mu.Unlock()
+		return ErrClosed
+	}
+	fetch, ok := v.resourceFetches[rns]
+	if !ok {
+		fetch = &resourceFetch{
+			status:  ResourceStatus{GVK: gvk, State: ResourceFetching},
+			attempt: make(chan struct{}),
+		}
+		v.resourceFetches[rns] = fetch
+	}
+	attempt := fetch.attempt
+	v.mu.Unlock()
+
+	if !ok {
+		err := v.startInformer(fetch)
+		v.mu.Lock()
+		if err != nil {
+			// Forget the fetch so that the next lookup tries again.
+			delete(v.resourceFetches, rns)
+			fetch.status.State = ResourceFailing
+			fetch.fail(err)
+		}
+		fetch.attempt = nil
+		close(attempt)
+		v.mu.Unlock()
+	} else if attempt != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-attempt:
+		}
+	}
+
+	v.mu.Lock()
+	informer := fetch.informer
+	err := fetch.status.Err
+	v.mu.Unlock()
+	if informer == nil {
+		return err
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("waiting for %s metadata: %v", gvk.Kind, ctx.Err())
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if fetch.status.State == ResourceFetching {
+		// Event handlers added to a running informer get the existing objects
+		// asynchronously, so they may not have caught up yet.
+		for _, obj := range informer.GetStore().List() {
+			v.cacheInformerObject(gvk, obj)
+		}
+		fetch.succeed()
+		fetch.status.LastSync = time.Now()
+	}
+	return nil
+}
+
+func (v *OwnerFetcher) startInformer(fetch *resourceFetch) error {
+	gvk := fetch.status.GVK
+	mapping, err := v.restMapping(gvk)
+	if err != nil {
+		return fmt.Errorf("mapping %s: %v", gvk, err)
+	}
+	fetch.gvr = mapping.Resource
+
+	informer := v.informers.ForResource(mapping.Resource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			v.cacheInformerObject(gvk, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			v.cacheInformerObject(gvk, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// If the informer missed the delete, it hands us its last
+			// known state instead.
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			m, ok := obj.(*metav1.PartialObjectMetadata)
+			if !ok {
+				return
+			}
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			if v.closed {
+				return
+			}
+			v.forgetDeleted(m.GetUID())
+		},
+	})
+
+	// Only starts informers that aren't running yet.
+	v.informers.Start(v.informerStop)
+
+	v.mu.Lock()
+	fetch.informer = informer
+	v.mu.Unlock()
+	return nil
+}
+
+// Informer objects are shared with other handlers, so we must not modify
+// them. cacheMeta only reads them.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) cacheInformerObject(gvk schema.GroupVersionKind, obj interface{}) {
+	m, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok || v.closed {
+		return
+	}
+	v.cacheMeta(gvk, &m.ObjectMeta)
+}
@@ -0,0 +1,144 @@
+package tilt
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/metadata/metadatainformer"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// An OwnerFetcher backed by shared informers for a fake cluster, closed and
+// stopped when the test ends.
+func newTestInformerOwnerFetcher(t *testing.T, objs ...runtime.Object) *OwnerFetcher {
+	client := newTestMetadataClient(objs...)
+	ctx, cancel := context.WithCancel(context.Background())
+	informers := metadatainformer.NewSharedInformerFactory(client, 0)
+	v := NewOwnerFetcherForInformers(ctx, newTestMapper(), client, informers)
+	t.Cleanup(func() {
+		_ = v.Close()
+		cancel()
+	})
+	return v
+}
+
+func TestInformerBackendMatchesListWatch(t *testing.T) {
+	// Two Deployments, one ReplicaSet with two owners, and a pod with no
+	// owner at all.
+	app := newMeta(deploymentGVK, "default", "app")
+	canary := newMeta(deploymentGVK, "default", "canary")
+	rs1 := newMeta(replicaSetGVK, "default", "app-1", app)
+	rs2 := newMeta(replicaSetGVK, "default", "app-2", app, canary)
+	pods := []*metav1.PartialObjectMetadata{
+		newMeta(podGVK, "default", "app-1-a", rs1),
+		newMeta(podGVK, "default", "app-1-b", rs1),
+		newMeta(podGVK, "default", "app-2-a", rs2),
+		newMeta(podGVK, "default", "bare"),
+	}
+	objs := []runtime.Object{app, canary, rs1, rs2}
+	for _, pod := range pods {
+		objs = append(objs, pod)
+	}
+
+	listWatch := newTestOwnerFetcher(t, newTestMapper(), objs...)
+	informer := newTestInformerOwnerFetcher(t, objs...)
+
+	for _, pod := range pods {
+		want, err := listWatch.OwnerTreeOf(lookupCtx(t), pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := informer.OwnerTreeOf(lookupCtx(t), pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected the informer tree of %s to be:\n%s\ngot:\n%s", pod.Name, want, got)
+		}
+	}
+
+	for _, deployment := range []*metav1.PartialObjectMetadata{app, canary} {
+		want, err := listWatch.DescendantsOf(lookupCtx(t), refOf(deployment), DeploymentDescendantKinds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := informer.DescendantsOf(lookupCtx(t), refOf(deployment), DeploymentDescendantKinds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected the informer descendants of %s to be:\n%s\ngot:\n%s", deployment.Name, want, got)
+		}
+	}
+}
+
+func TestInformerBackendHandlesTombstones(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(deployment, rs, pod)
+
+	// The informer's first watch misses the delete, then expires, so the
+	// relist finds the ReplicaSet gone and hands us a tombstone.
+	fw := watch.NewFakeWithChanSize(10, false)
+	var watches int64
+	client.PrependWatchReactor("replicasets", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if atomic.AddInt64(&watches, 1) == 1 {
+			return true, fw, nil
+		}
+		return false, nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers := metadatainformer.NewSharedInformerFactory(client, 0)
+	v := NewOwnerFetcherForInformers(ctx, newTestMapper(), client, informers)
+	defer v.Close()
+
+	tombstones := make(chan cache.DeletedFinalStateUnknown, 1)
+	rsGVR := replicaSetGVK.GroupVersion().WithResource("replicasets")
+	informers.ForResource(rsGVR).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				tombstones <- tombstone
+			}
+		},
+	})
+
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached(v, rs.UID) {
+		t.Fatalf("expected %s to be cached", rs.Name)
+	}
+
+	err = client.Resource(rsGVR).Namespace("default").Delete(context.Background(), rs.Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := errors.NewResourceExpired("too old resource version")
+	fw.Error(&expired.ErrStatus)
+
+	waitFor(t, "the tombstone to forget the ReplicaSet", func() bool {
+		return !cached(v, rs.UID)
+	})
+	select {
+	case <-tombstones:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the informer to deliver the delete as a tombstone")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.dependents[deployment.UID][rs.UID] {
+		t.Errorf("expected %s not to be a dependent of %s", rs.Name, deployment.Name)
+	}
+}
@@ -1,12 +1,13 @@
 package tilt
 
 import (
+	"container/list"
 	"context"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -18,6 +19,7 @@ import (
 	"k8s.io/client-go/discovery"
 	memory "k8s.io/client-go/discovery/cached"
 	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 )
@@ -25,8 +27,39 @@ import (
 // The ObjectRefTree only contains immutable properties
 // of a Kubernetes object: the name, namespace, and UID
 type ObjectRefTree struct {
-	Ref    v1.ObjectReference
-	Owners []ObjectRefTree
+	Ref    v1.ObjectReference `json:"ref"`
+	Owners []ObjectRefTree    `json:"owners,omitempty"`
+
+	// The flags of the owner reference that points at this object from the
+	// object below it. Always false at the root.
+	Controller         bool `json:"controller,omitempty"`
+	BlockOwnerDeletion bool `json:"blockOwnerDeletion,omitempty"`
+
+	// Set when this object already appears further down the tree, i.e.,
+	// it owns itself. Its owners are cut off to break the cycle.
+	Cyclic bool `json:"cyclic,omitempty"`
+
+	// Set when the cluster doesn't serve this object's kind, e.g., its CRD
+	// was uninstalled, so we can't look up its owners.
+	UnknownKind bool `json:"unknownKind,omitempty"`
+}
+
+// A CycleError means that an object owns itself, directly or through other
+// owners. A buggy operator can create one.
+//
+// The OwnerFetcher returns it along with a partial tree, which stops at the
+// first repeated owner.
+type CycleError struct {
+	// The owner chain that led back to an object we were already looking up.
+	Cycle []v1.ObjectReference
+}
+
+func (e *CycleError) Error() string {
+	names := []string{}
+	for _, ref := range e.Cycle {
+		names = append(names, fmt.Sprintf("%s:%s", ref.Kind, ref.Name))
+	}
+	return fmt.Sprintf("owner reference cycle: %s", strings.Join(names, " -> "))
 }
 
 func (t ObjectRefTree) ContainsUID(uid types.UID) bool {
@@ -42,7 +75,14 @@ func (t ObjectRefTree) ContainsUID(uid types.UID) bool {
 }
 
 func (t ObjectRefTree) stringLines() []string {
-	result := []string{fmt.Sprintf("%s:%s", t.Ref.Kind, t.Ref.Name)}
+	line := fmt.Sprintf("%s:%s", t.Ref.Kind, t.Ref.Name)
+	if t.Cyclic {
+		line += " (cycle)"
+	}
+	if t.UnknownKind {
+		line += " (unknown kind)"
+	}
+	result := []string{line}
 	for _, owner := range t.Owners {
 		// indent each of the owners by two spaces
 		branchLines := owner.stringLines()
@@ -58,6 +98,7 @@ func (t ObjectRefTree) String() string {
 }
 
 type restMapper interface {
+	KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error)
 	RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error)
 }
 
@@ -66,128 +107,195 @@ type resourceNamespace struct {
 	GVK       schema.GroupVersionKind
 }
 
+// ErrClosed is returned by lookups after the OwnerFetcher is closed.
+var ErrClosed = fmt.Errorf("OwnerFetcher is closed")
+
 type OwnerFetcher struct {
-	globalCtx  context.Context
+	// Cancelled by Close, which stops every watch.
+	globalCtx context.Context
+	cancel    context.CancelFunc
+
+	// The goroutines Close waits for. Guarded by mu, so that we never add
+	// one after Close starts waiting.
+	goroutines sync.WaitGroup
+	closed     bool
+
 	restMapper restMapper
 	metadata   metadata.Interface
-	cache      map[types.UID]*objectTreePromise
-	mu         *sync.Mutex
 
-	metaCache       map[types.UID]*metav1.ObjectMeta
-	resourceFetches map[resourceNamespace]*sync.Once
+	// The last time we reset the discovery cache. Guarded by mu.
+	lastDiscoveryReset time.Time
+
+	cache map[types.UID]*objectTreePromise
+	mu    sync.Mutex
+
+	metaCache       map[types.UID]cachedMeta
+	resourceFetches map[resourceNamespace]*resourceFetch
+	cacheOpts       CacheOptions
+
+	// The UIDs in metaCache, most recently used first.
+	lru *list.List
+
+	// A reverse index of metaCache: owner UID -> the UIDs it owns.
+	dependents map[types.UID]map[types.UID]bool
+
+	// What each object's owner tree was built from, so that we can tell
+	// when its owner references change.
+	sources map[types.UID]treeSource
+
+	subscriptions map[types.UID]map[*subscription]bool
+
+	// If set, fills the batch cache instead of our own lists and watches.
+	informers metadatainformer.SharedInformerFactory
+
+	// Stops the informers we start. Other users of the factory share them,
+	// so it's the caller's, not ours.
+	informerStop <-chan struct{}
 }
 
-func NewOwnerFetcher(ctx context.Context, config *rest.Config) OwnerFetcher {
+// NewOwnerFetcher creates an OwnerFetcher for a cluster. Its watches run
+// until ctx is done or it's closed.
+func NewOwnerFetcher(ctx context.Context, config *rest.Config) (*OwnerFetcher, error) {
 	meta, err := metadata.NewForConfig(config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	return NewOwnerFetcherForClients(ctx, mapper, meta), nil
+}
 
-	return OwnerFetcher{
+// NewOwnerFetcherForClients creates an OwnerFetcher from existing clients,
+// e.g., fakes in a simulated cluster.
+func NewOwnerFetcherForClients(ctx context.Context, mapper meta.RESTMapper, metaClient metadata.Interface) *OwnerFetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &OwnerFetcher{
 		globalCtx:  ctx,
+		cancel:     cancel,
 		restMapper: mapper,
-		metadata:   meta,
+		metadata:   metaClient,
 		cache:      make(map[types.UID]*objectTreePromise),
-		mu:         &sync.Mutex{},
 
-		metaCache:       make(map[types.UID]*metav1.ObjectMeta),
-		resourceFetches: make(map[resourceNamespace]*sync.Once),
+		metaCache:       make(map[types.UID]cachedMeta),
+		lru:             list.New(),
+		resourceFetches: make(map[resourceNamespace]*resourceFetch),
+		dependents:      make(map[types.UID]map[types.UID]bool),
+		sources:         make(map[types.UID]treeSource),
+		subscriptions:   make(map[types.UID]map[*subscription]bool),
 	}
 }
 
-func (v OwnerFetcher) getOrCreateResourceFetch(gvk schema.GroupVersionKind, ns string) *sync.Once {
+// Close stops every watch, and waits for them to exit. Lookups in progress
+// fail, and later lookups return ErrClosed.
+//
+// With the informer backend, the informers keep running, since other users
+// of the factory may depend on them.
+func (v *OwnerFetcher) Close() error {
 	v.mu.Lock()
-	defer v.mu.Unlock()
-	rns := resourceNamespace{Namespace: ns, GVK: gvk}
-	fetch, ok := v.resourceFetches[rns]
-	if !ok {
-		fetch = &sync.Once{}
-		v.resourceFetches[rns] = fetch
-	}
-	return fetch
-}
-
-// As an optimization, we batch fetch all the ObjectMetas of a resource type
-// the first time we need that resource, then watch updates.
-func (v OwnerFetcher) ensureResourceFetched(gvk schema.GroupVersionKind, ns string) {
-	fetch := v.getOrCreateResourceFetch(gvk, ns)
-	fetch.Do(func() {
-		mapping, err := v.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
-		if err != nil {
-			log.Printf("Error mapping GroupVersionKind: %v", err)
-			return
-		}
-		gvr := mapping.Resource
-
-		metas, err := v.metadata.Resource(gvr).Namespace(ns).List(v.globalCtx, metav1.ListOptions{})
-		if err != nil {
-			log.Printf("Error fetching metadata: %v", err)
-			return
-		}
-
-		v.mu.Lock()
-		for _, meta := range metas.Items {
-			v.metaCache[meta.ObjectMeta.GetUID()] = &meta.ObjectMeta
-		}
-		v.mu.Unlock()
+	v.closed = true
+	v.mu.Unlock()
 
-		w, err := v.metadata.Resource(gvr).Namespace(ns).Watch(v.globalCtx, metav1.ListOptions{})
-		if err != nil {
-			log.Printf("Error watching metadata: %v", err)
-			return
-		}
+	v.cancel()
+	v.goroutines.Wait()
+	return nil
+}
 
-		go func() {
-			for event := range w.ResultChan() {
-				m, ok := event.Object.(*metav1.PartialObjectMetadata)
-				if ok {
-					v.mu.Lock()
-					v.metaCache[m.ObjectMeta.GetUID()] = &m.ObjectMeta
-					v.mu.Unlock()
-				}
-			}
-		}()
-	})
+// Runs fn in a goroutine that Close waits for, unless we're closed.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) spawn(fn func()) {
+	if v.closed {
+		return
+	}
+	v.goroutines.Add(1)
+	go func() {
+		defer v.goroutines.Done()
+		fn()
+	}()
 }
 
-// Returns a promise and a boolean. The boolean is true if the promise is
+// Returns a promise and two booleans. The first is true if the promise is
 // already in progress, and false if the caller is responsible for
 // resolving/rejecting the promise.
-func (v OwnerFetcher) getOrCreatePromise(id types.UID) (*objectTreePromise, bool) {
+//
+// The second is true if waiting on the promise would deadlock, because the
+// lookup that's resolving it is (transitively) waiting on this lookup.
+// That only happens when an object owns itself.
+func (v *OwnerFetcher) getOrCreatePromise(id types.UID, lookup *ownerLookup) (*objectTreePromise, bool, bool) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 	promise, ok := v.cache[id]
 	if !ok {
-		promise = newObjectTreePromise()
+		promise = newObjectTreePromise(lookup)
 		v.cache[id] = promise
+		lookup.visit(id)
+		lookup.resolving = append(lookup.resolving, promise)
+		return promise, false, false
+	}
+	if promise.waitsFor(lookup) {
+		return promise, true, true
 	}
-	return promise, ok
+	lookup.waitingOn = promise
+	return promise, true, false
 }
 
-func (v OwnerFetcher) OwnerTreeOfRef(ctx context.Context, ref v1.ObjectReference) (result ObjectRefTree, err error) {
+// Waits for another lookup to settle a promise, or for ctx to be done.
+//
+// If the other lookup was cancelled, its error isn't ours, so we report
+// retry and the caller looks the object up itself.
+//
+// The promise's tree becomes part of every tree this lookup is resolving,
+// so if it's stale, they are too.
+func (v *OwnerFetcher) wait(ctx context.Context, lookup *ownerLookup, promise *objectTreePromise) (tree ObjectRefTree, retry bool, err error) {
+	tree, err = promise.wait(ctx)
+	v.mu.Lock()
+	lookup.waitingOn = nil
+	retry = err != nil && promise.cancelled && ctx.Err() == nil && !v.closed
+	tree.Walk(func(t ObjectRefTree, depth int) bool {
+		lookup.visit(t.Ref.UID)
+		return true
+	})
+	if promise.stale {
+		for _, p := range lookup.resolving {
+			p.stale = true
+		}
+	}
+	v.mu.Unlock()
+	return tree, retry, err
+}
+
+func (v *OwnerFetcher) OwnerTreeOfRef(ctx context.Context, ref v1.ObjectReference) (result ObjectRefTree, err error) {
+	return v.ownerTreeOfRef(ctx, &ownerLookup{}, ref)
+}
+
+func (v *OwnerFetcher) ownerTreeOfRef(ctx context.Context, lookup *ownerLookup, ref v1.ObjectReference) (result ObjectRefTree, err error) {
 	uid := ref.UID
 	if uid == "" {
 		return ObjectRefTree{}, fmt.Errorf("Can only get owners of deployed entities")
 	}
+	if v.globalCtx.Err() != nil {
+		return ObjectRefTree{}, ErrClosed
+	}
 
-	promise, ok := v.getOrCreatePromise(uid)
+	promise, ok, cycle := v.getOrCreatePromise(uid, lookup)
+	if cycle {
+		return ObjectRefTree{Ref: ref, Cyclic: true}, lookup.cycleError(ref)
+	}
 	if ok {
-		return promise.wait()
+		tree, retry, err := v.wait(ctx, lookup, promise)
+		if retry {
+			return v.ownerTreeOfRef(ctx, lookup, ref)
+		}
+		return tree, err
 	}
 
 	defer func() {
-		if err != nil {
-			promise.reject(err)
-		} else {
-			promise.resolve(result)
-		}
+		v.settle(ctx, uid, promise, result, err)
 	}()
 
 	meta, err := v.getMetaByReference(ctx, ref)
@@ -195,26 +303,35 @@ func (v OwnerFetcher) OwnerTreeOfRef(ctx context.Context, ref v1.ObjectReference
 		if errors.IsNotFound(err) {
 			return ObjectRefTree{Ref: ref}, nil
 		}
+		if isUnknownKind(err) {
+			return ObjectRefTree{Ref: ref, UnknownKind: true}, nil
+		}
 		return ObjectRefTree{}, err
 	}
-	return v.ownerTreeOfHelper(ctx, ref, meta)
+	return v.ownerTreeOfHelper(ctx, lookup, ref, meta)
 }
 
-func (v OwnerFetcher) getMetaByReference(ctx context.Context, ref v1.ObjectReference) (*metav1.ObjectMeta, error) {
+func (v *OwnerFetcher) getMetaByReference(ctx context.Context, ref v1.ObjectReference) (*metav1.ObjectMeta, error) {
 	gvk := ref.GroupVersionKind()
-	mapping, err := v.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	mapping, err := v.restMapping(gvk)
 	if err != nil {
 		return nil, err
 	}
 	gvr := mapping.Resource
-	v.ensureResourceFetched(gvk, string(ref.Namespace))
+	err = v.ensureResourceFetched(ctx, gvk, string(ref.Namespace))
+	if err != nil {
+		return nil, err
+	}
 
 	v.mu.Lock()
-	meta, ok := v.metaCache[ref.UID]
+	cached, ok := v.metaCache[ref.UID]
+	if ok {
+		v.touchMeta(cached)
+	}
 	v.mu.Unlock()
 
 	if ok {
-		return meta, nil
+		return cached.meta, nil
 	}
 
 	obj, err := v.metadata.Resource(gvr).Namespace(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
@@ -224,80 +341,251 @@ func (v OwnerFetcher) getMetaByReference(ctx context.Context, ref v1.ObjectRefer
 	return &obj.ObjectMeta, nil
 }
 
-func (v OwnerFetcher) OwnerTreeOf(ctx context.Context, obj runtime.Object) (result ObjectRefTree, err error) {
+func (v *OwnerFetcher) OwnerTreeOf(ctx context.Context, obj runtime.Object) (result ObjectRefTree, err error) {
 	t := reflect.ValueOf(obj).Elem().FieldByName("TypeMeta").Interface().(metav1.TypeMeta)
 	meta := reflect.ValueOf(obj).Elem().FieldByName("ObjectMeta").Interface().(metav1.ObjectMeta)
+	ref := v1.ObjectReference{
+		Name:       meta.Name,
+		Namespace:  meta.Namespace,
+		Kind:       t.Kind,
+		UID:        meta.UID,
+		APIVersion: t.APIVersion,
+	}
+	return v.ownerTreeOfMeta(ctx, ref, &meta)
+}
+
+func (v *OwnerFetcher) ownerTreeOfMeta(ctx context.Context, ref v1.ObjectReference, meta *metav1.ObjectMeta) (result ObjectRefTree, err error) {
 	uid := meta.GetUID()
 	if uid == "" {
 		return ObjectRefTree{}, fmt.Errorf("Can only get owners of deployed entities")
 	}
+	if v.globalCtx.Err() != nil {
+		return ObjectRefTree{}, ErrClosed
+	}
 
-	promise, ok := v.getOrCreatePromise(uid)
+	// The caller may have a newer version of the object than we do, e.g.,
+	// a pod that was just adopted.
+	v.mu.Lock()
+	v.checkSource(uid, meta)
+	v.mu.Unlock()
+
+	lookup := &ownerLookup{}
+	promise, ok, _ := v.getOrCreatePromise(uid, lookup)
 	if ok {
-		return promise.wait()
+		// A new lookup can't be part of a cycle yet.
+		tree, retry, err := v.wait(ctx, lookup, promise)
+		if retry {
+			return v.ownerTreeOfMeta(ctx, ref, meta)
+		}
+		return tree, err
 	}
 
 	defer func() {
-		if err != nil {
-			promise.reject(err)
-		} else {
-			promise.resolve(result)
-		}
+		v.settle(ctx, uid, promise, result, err)
 	}()
 
-	ref := v1.ObjectReference{
-		Name:       meta.Name,
-		Namespace:  meta.Namespace,
-		Kind:       t.Kind,
-		UID:        meta.UID,
-		APIVersion: t.APIVersion,
-	}
-	return v.ownerTreeOfHelper(ctx, ref, &meta)
+	return v.ownerTreeOfHelper(ctx, lookup, ref, meta)
 }
 
-func (v OwnerFetcher) ownerTreeOfHelper(ctx context.Context, ref v1.ObjectReference, meta *metav1.ObjectMeta) (ObjectRefTree, error) {
+// If an owner is part of a cycle, we keep going with the rest of the owners,
+// and return the partial tree along with the CycleError.
+func (v *OwnerFetcher) ownerTreeOfHelper(ctx context.Context, lookup *ownerLookup, ref v1.ObjectReference, meta *metav1.ObjectMeta) (ObjectRefTree, error) {
+	lookup.path = append(lookup.path, ref)
+	defer func() {
+		lookup.path = lookup.path[:len(lookup.path)-1]
+	}()
+
+	v.mu.Lock()
+	v.sources[ref.UID] = treeSource{ref: ref, meta: trimMeta(meta)}
+	v.mu.Unlock()
+
 	tree := ObjectRefTree{Ref: ref}
+	var cycleErr error
 	owners := meta.GetOwnerReferences()
 	for _, owner := range owners {
 		ownerRef := v1.ObjectReference{
 			Name:       owner.Name,
-			Namespace:  meta.GetNamespace(),
 			Kind:       owner.Kind,
 			UID:        owner.UID,
 			APIVersion: owner.APIVersion,
 		}
-		ownerTree, err := v.OwnerTreeOfRef(ctx, ownerRef)
+		ns, err := v.ownerNamespace(ownerRef, meta.GetNamespace())
 		if err != nil {
 			return ObjectRefTree{}, err
 		}
+		ownerRef.Namespace = ns
+
+		ownerTree, err := v.ownerTreeOfRef(ctx, lookup, ownerRef)
+		if err != nil {
+			_, isCycle := err.(*CycleError)
+			if !isCycle {
+				return ObjectRefTree{}, err
+			}
+			if cycleErr == nil {
+				cycleErr = err
+			}
+		}
+
+		// The cached tree of the owner is shared by everything it owns, but
+		// ownerTree is a copy, so we can set the flags of this reference.
+		ownerTree.Controller = owner.Controller != nil && *owner.Controller
+		ownerTree.BlockOwnerDeletion = owner.BlockOwnerDeletion != nil && *owner.BlockOwnerDeletion
 		tree.Owners = append(tree.Owners, ownerTree)
 	}
-	return tree, nil
+	return tree, cycleErr
+}
+
+// Settles a promise that this lookup is responsible for.
+//
+// Errors are often transient, e.g., the API server is unavailable, so we
+// forget the promise and let the next lookup try again. Cycles won't go away
+// on their own, so we keep those.
+//
+// If owner references changed while we were looking up the tree, it may be
+// out of date, so we forget it and rebuild it for subscribers. We also forget
+// trees with unknown kinds in them, in case their CRDs get installed.
+func (v *OwnerFetcher) settle(ctx context.Context, uid types.UID, promise *objectTreePromise, tree ObjectRefTree, err error) {
+	_, isCycle := err.(*CycleError)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lookup := promise.resolver
+	lookup.resolving = lookup.resolving[:len(lookup.resolving)-1]
+	promise.visited = nil
+
+	forget := promise.stale || (err != nil && !isCycle) || hasUnknownKind(tree)
+	if forget && v.cache[uid] == promise {
+		delete(v.cache, uid)
+	}
+	promise.cancelled = ctx.Err() != nil
+	promise.settle(tree, err)
+
+	if promise.stale && len(v.subscriptions[uid]) > 0 {
+		v.spawn(func() { v.rebuild(uid) })
+	}
+}
+
+// Owner references don't have a namespace, because namespaced objects can
+// only be owned by objects in the same namespace. But anything can be owned
+// by a cluster-scoped object, e.g., a Node owns the mirror pods of its static
+// pods, so we need to check the owner's scope.
+//
+// If the owner's kind is unknown, we can't tell, so we guess the child's
+// namespace. Its lookup will fail the same way, and stop at the owner.
+func (v *OwnerFetcher) ownerNamespace(owner v1.ObjectReference, childNamespace string) (string, error) {
+	mapping, err := v.restMapping(owner.GroupVersionKind())
+	if isUnknownKind(err) {
+		return childNamespace, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return "", nil
+	}
+	return childNamespace, nil
+}
+
+// A single call to OwnerTreeOf, which may recursively look up many owners.
+//
+// The OwnerFetcher lock guards waitingOn, so that other lookups can check
+// whether waiting on us would deadlock.
+type ownerLookup struct {
+	// The objects we're in the middle of looking up, from the original
+	// object to the current owner.
+	path []v1.ObjectReference
+
+	// The promise we're blocked on, if any.
+	waitingOn *objectTreePromise
+
+	// The promises this lookup is responsible for and hasn't settled yet,
+	// from the original object to the current owner.
+	resolving []*objectTreePromise
+}
+
+// Records that every tree we're resolving contains uid.
+//
+// Must hold the OwnerFetcher lock.
+func (l *ownerLookup) visit(uid types.UID) {
+	for _, p := range l.resolving {
+		p.visited[uid] = true
+	}
+}
+
+func (l *ownerLookup) cycleError(ref v1.ObjectReference) *CycleError {
+	cycle := append([]v1.ObjectReference{}, l.path...)
+	for i, r := range l.path {
+		if r.UID == ref.UID {
+			cycle = cycle[i:]
+			break
+		}
+	}
+	return &CycleError{Cycle: append(cycle, ref)}
 }
 
 type objectTreePromise struct {
 	tree ObjectRefTree
 	err  error
 	done chan struct{}
+
+	// The lookup responsible for settling this promise.
+	resolver *ownerLookup
+
+	// Set when owner references changed in the tree, either while the
+	// promise was in progress or after. Guarded by the OwnerFetcher lock.
+	stale bool
+
+	// The objects in the tree so far, while the promise is in progress.
+	// Guarded by the OwnerFetcher lock.
+	visited map[types.UID]bool
+
+	// Set when the lookup settling this promise was cancelled, so its error
+	// is no use to anyone else. Guarded by the OwnerFetcher lock.
+	cancelled bool
 }
 
-func newObjectTreePromise() *objectTreePromise {
+func newObjectTreePromise(resolver *ownerLookup) *objectTreePromise {
 	return &objectTreePromise{
-		done: make(chan struct{}),
+		done:     make(chan struct{}),
+		resolver: resolver,
+		visited:  make(map[types.UID]bool),
 	}
 }
 
-func (e *objectTreePromise) resolve(tree ObjectRefTree) {
+// The tree may be partial if there's an error.
+func (e *objectTreePromise) settle(tree ObjectRefTree, err error) {
 	e.tree = tree
+	e.err = err
 	close(e.done)
 }
 
-func (e *objectTreePromise) reject(err error) {
-	e.err = err
-	close(e.done)
+func (e *objectTreePromise) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reports whether waiting on this promise would end up waiting on lookup,
+// by following the chain of lookups that are waiting on each other.
+//
+// Must hold the OwnerFetcher lock.
+func (e *objectTreePromise) waitsFor(lookup *ownerLookup) bool {
+	for p := e; p != nil && !p.isDone(); p = p.resolver.waitingOn {
+		if p.resolver == lookup {
+			return true
+		}
+	}
+	return false
 }
 
-func (e *objectTreePromise) wait() (ObjectRefTree, error) {
-	<-e.done
-	return e.tree, e.err
+func (e *objectTreePromise) wait(ctx context.Context) (ObjectRefTree, error) {
+	select {
+	case <-ctx.Done():
+		return ObjectRefTree{}, ctx.Err()
+	case <-e.done:
+		return e.tree, e.err
+	}
 }
@@ -0,0 +1,334 @@
+package tilt
+
+import (
+	"context"
+	goruntime "runtime"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/metadata/metadatainformer"
+)
+
+var (
+	podGVK        = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	replicaSetGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}
+	deploymentGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+)
+
+func newTestMapper() *meta.DefaultRESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(podGVK, meta.RESTScopeNamespace)
+	mapper.Add(replicaSetGVK, meta.RESTScopeNamespace)
+	mapper.Add(deploymentGVK, meta.RESTScopeNamespace)
+	return mapper
+}
+
+func newTestMetadataClient(objs ...runtime.Object) *metadatafake.FakeMetadataClient {
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	return metadatafake.NewSimpleMetadataClient(scheme, objs...)
+}
+
+// An OwnerFetcher for objects in a fake cluster, closed when the test ends.
+func newTestOwnerFetcher(t testing.TB, mapper meta.RESTMapper, objs ...runtime.Object) *OwnerFetcher {
+	return newTestOwnerFetcherForClient(t, mapper, newTestMetadataClient(objs...))
+}
+
+func newTestOwnerFetcherForClient(t testing.TB, mapper meta.RESTMapper, client *metadatafake.FakeMetadataClient) *OwnerFetcher {
+	v := NewOwnerFetcherForClients(context.Background(), mapper, client)
+	t.Cleanup(func() { _ = v.Close() })
+	return v
+}
+
+// An object's metadata, owned by owners.
+func newMeta(gvk schema.GroupVersionKind, ns, name string, owners ...*metav1.PartialObjectMetadata) *metav1.PartialObjectMetadata {
+	m := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{Kind: gvk.Kind, APIVersion: gvk.GroupVersion().String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			UID:       types.UID(name + "-uid"),
+		},
+	}
+	for _, owner := range owners {
+		addOwner(m, owner)
+	}
+	return m
+}
+
+func addOwner(m, owner *metav1.PartialObjectMetadata) {
+	m.OwnerReferences = append(m.OwnerReferences, metav1.OwnerReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	})
+}
+
+func refOf(m *metav1.PartialObjectMetadata) v1.ObjectReference {
+	return v1.ObjectReference{
+		APIVersion: m.APIVersion,
+		Kind:       m.Kind,
+		Namespace:  m.Namespace,
+		Name:       m.Name,
+		UID:        m.UID,
+	}
+}
+
+// Fails the test if a lookup takes long enough that it's probably deadlocked.
+func lookupCtx(t testing.TB) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func assertCycle(t *testing.T, tree ObjectRefTree, err error, uids ...types.UID) {
+	t.Helper()
+	if _, ok := err.(*CycleError); !ok {
+		t.Fatalf("expected a CycleError, got: %v", err)
+	}
+	for _, uid := range uids {
+		if !tree.ContainsUID(uid) {
+			t.Errorf("expected the partial tree to contain %s, got:\n%s", uid, tree)
+		}
+	}
+	cyclic := false
+	tree.Walk(func(t ObjectRefTree, depth int) bool {
+		cyclic = cyclic || t.Cyclic
+		return true
+	})
+	if !cyclic {
+		t.Errorf("expected a node marked cyclic, got:\n%s", tree)
+	}
+}
+
+func TestOwnerTreeOfSelfOwned(t *testing.T) {
+	rs := newMeta(replicaSetGVK, "default", "rs")
+	addOwner(rs, rs)
+	pod := newMeta(podGVK, "default", "pod", rs)
+	v := newTestOwnerFetcher(t, newTestMapper(), rs, pod)
+
+	tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	assertCycle(t, tree, err, pod.UID, rs.UID)
+
+	cycle := err.(*CycleError).Cycle
+	if len(cycle) != 2 || cycle[0].UID != rs.UID || cycle[1].UID != rs.UID {
+		t.Errorf("expected the cycle rs -> rs, got: %v", err)
+	}
+}
+
+func TestOwnerTreeOfThreeHopCycle(t *testing.T) {
+	a := newMeta(replicaSetGVK, "default", "a")
+	b := newMeta(replicaSetGVK, "default", "b")
+	c := newMeta(replicaSetGVK, "default", "c")
+	addOwner(a, b)
+	addOwner(b, c)
+	addOwner(c, a)
+	pod := newMeta(podGVK, "default", "pod", a)
+
+	tests := []struct {
+		name  string
+		from  *metav1.PartialObjectMetadata
+		cycle []types.UID
+	}{
+		{"from a pod", pod, []types.UID{a.UID, b.UID, c.UID, a.UID}},
+		{"from the middle", b, []types.UID{b.UID, c.UID, a.UID, b.UID}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestOwnerFetcher(t, newTestMapper(), a, b, c, pod)
+
+			tree, err := v.OwnerTreeOfRef(lookupCtx(t), refOf(test.from))
+			assertCycle(t, tree, err, a.UID, b.UID, c.UID)
+
+			cycle := err.(*CycleError).Cycle
+			if len(cycle) != len(test.cycle) {
+				t.Fatalf("expected a cycle of %d refs, got: %v", len(test.cycle), err)
+			}
+			for i, uid := range test.cycle {
+				if cycle[i].UID != uid {
+					t.Errorf("expected %s at %d in the cycle, got: %v", uid, i, err)
+				}
+			}
+
+			// Cycles don't go away on their own, so the next lookup uses the cache.
+			_, err = v.OwnerTreeOfRef(lookupCtx(t), refOf(test.from))
+			if _, ok := err.(*CycleError); !ok {
+				t.Errorf("expected a cached CycleError, got: %v", err)
+			}
+		})
+	}
+}
+
+// Two lookups that enter the cycle at different objects each end up
+// waiting on the other. Neither should deadlock.
+func TestOwnerTreeOfConcurrentCycleEntries(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		a := newMeta(replicaSetGVK, "default", "a")
+		b := newMeta(replicaSetGVK, "default", "b")
+		c := newMeta(replicaSetGVK, "default", "c")
+		addOwner(a, b)
+		addOwner(b, c)
+		addOwner(c, a)
+		podA := newMeta(podGVK, "default", "pod-a", a)
+		podC := newMeta(podGVK, "default", "pod-c", c)
+		v := newTestOwnerFetcher(t, newTestMapper(), a, b, c, podA, podC)
+
+		trees := make([]ObjectRefTree, 2)
+		errs := make([]error, 2)
+		wg := sync.WaitGroup{}
+		for j, pod := range []*metav1.PartialObjectMetadata{podA, podC} {
+			j, pod := j, pod
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				trees[j], errs[j] = v.OwnerTreeOf(lookupCtx(t), pod)
+			}()
+		}
+		wg.Wait()
+
+		// Where each tree is cut off depends on which lookup got where first.
+		if errs[0] == context.DeadlineExceeded || errs[1] == context.DeadlineExceeded {
+			t.Fatalf("lookups deadlocked: %v, %v", errs[0], errs[1])
+		}
+		assertCycle(t, trees[0], errs[0], podA.UID, a.UID)
+		assertCycle(t, trees[1], errs[1], podC.UID, c.UID)
+	}
+}
+
+func TestOwnerTreeOfClusterScopedOwners(t *testing.T) {
+	nodeGVK := schema.GroupVersionKind{Version: "v1", Kind: "Node"}
+	tenantGVK := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Tenant"}
+	orgGVK := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Org"}
+	mapper := newTestMapper()
+	mapper.Add(nodeGVK, meta.RESTScopeRoot)
+	mapper.Add(tenantGVK, meta.RESTScopeRoot)
+	mapper.Add(orgGVK, meta.RESTScopeRoot)
+
+	// The kubelet creates a mirror pod for each static pod, owned by its Node.
+	node := newMeta(nodeGVK, "", "node-1")
+	mirrorPod := newMeta(podGVK, "kube-system", "kube-apiserver-node-1", node)
+
+	org := newMeta(orgGVK, "", "acme")
+	tenant := newMeta(tenantGVK, "", "team-a", org)
+	deployment := newMeta(deploymentGVK, "team-a", "app", tenant)
+
+	tests := []struct {
+		name string
+		obj  *metav1.PartialObjectMetadata
+
+		// The owners we expect to find, from the object up. Each is
+		// cluster-scoped.
+		owners []*metav1.PartialObjectMetadata
+	}{
+		{"mirror pod owned by a Node", mirrorPod, []*metav1.PartialObjectMetadata{node}},
+		{"custom cluster-scoped owner", deployment, []*metav1.PartialObjectMetadata{tenant, org}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestOwnerFetcher(t, mapper, node, mirrorPod, org, tenant, deployment)
+
+			tree, err := v.OwnerTreeOf(lookupCtx(t), test.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, owner := range test.owners {
+				if len(tree.Owners) != 1 {
+					t.Fatalf("expected %s to have one owner, got:\n%s", tree.Ref.Name, tree)
+				}
+				tree = tree.Owners[0]
+				if tree.Ref.UID != owner.UID || tree.Ref.Namespace != "" {
+					t.Fatalf("expected cluster-scoped %s, got %s in namespace %q", owner.Name, tree.Ref.Name, tree.Ref.Namespace)
+				}
+			}
+
+			// A lookup in the child's namespace would come back not found,
+			// and we'd never cache the owner.
+			v.mu.Lock()
+			_, cached := v.metaCache[tree.Ref.UID]
+			v.mu.Unlock()
+			if !cached {
+				t.Errorf("expected %s to be fetched without a namespace", tree.Ref.Name)
+			}
+		})
+	}
+}
+
+func TestCloseStopsEveryGoroutine(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(deployment, rs, pod)
+
+	before := goruntime.NumGoroutine()
+	v := NewOwnerFetcherForClients(context.Background(), newTestMapper(), client)
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForWatch(t, client, "replicasets")
+	waitForWatch(t, client, "deployments")
+
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := goruntime.NumGoroutine(); n > before {
+		t.Errorf("expected Close to stop every goroutine it spawned: %d before, %d after", before, n)
+	}
+
+	_, err = v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got: %v", err)
+	}
+}
+
+func TestCloseLeavesSharedInformersRunning(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(deployment, rs, pod)
+
+	before := goruntime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	informers := metadatainformer.NewSharedInformerFactory(client, 0)
+	v := NewOwnerFetcherForInformers(ctx, newTestMapper(), client, informers)
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another user of the factory still sees new ReplicaSets.
+	rsGVR := replicaSetGVK.GroupVersion().WithResource("replicasets")
+	waitForWatch(t, client, rsGVR.Resource)
+	added := newMeta(replicaSetGVK, "default", "app-2", deployment)
+	_, err = client.Resource(rsGVR).Namespace("default").(metadatafake.MetadataClient).
+		CreateFake(added, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := informers.ForResource(rsGVR).Informer().GetStore()
+	waitFor(t, "the shared informer to see a new ReplicaSet", func() bool {
+		_, ok, _ := store.GetByKey("default/app-2")
+		return ok
+	})
+
+	// The informers stop when the caller is done with them.
+	cancel()
+	waitFor(t, "the informers to stop", func() bool {
+		return goruntime.NumGoroutine() <= before
+	})
+}
@@ -2,18 +2,121 @@ package tilt
 
 import (
 	"crypto"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 )
 
 const TiltPodTemplateHashLabel = "tilt.dev/pod-template-hash"
 
+// The version of the hashing algorithm that HashPodTemplateSpec uses.
+//
+// Bump it whenever the canonical form changes, and keep computing the old
+// versions in hashPodTemplateSpecVersion, so that pods labeled by an older
+// version are still recognized.
+const PodTemplateHashVersion = 2
+
+// Version 1 hashes have no prefix. Later versions look like "v2-0123abcd...".
+var (
+	legacyHashRe    = regexp.MustCompile(`^[0-9a-f]{20}$`)
+	versionedHashRe = regexp.MustCompile(`^v([0-9]+)-[0-9a-f]{20}$`)
+)
+
 type PodTemplateSpecHash string
 
+// Version is the algorithm version that computed the hash, or 0 if it
+// doesn't look like a hash we computed.
+func (h PodTemplateSpecHash) Version() int {
+	if legacyHashRe.MatchString(string(h)) {
+		return 1
+	}
+	match := versionedHashRe.FindStringSubmatch(string(h))
+	if match == nil {
+		return 0
+	}
+	version, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// HashPodTemplateSpec hashes a canonical form of the template, so that the
+// hash doesn't change when the server fills in defaults, when a k8s bump
+// adds fields, or when we add the hash label itself.
 func HashPodTemplateSpec(spec *v1.PodTemplateSpec) (PodTemplateSpecHash, error) {
+	return hashPodTemplateSpecVersion(spec, PodTemplateHashVersion)
+}
+
+// MatchesPodTemplateSpec checks whether a hash, from any version we know,
+// was computed from this template.
+func MatchesPodTemplateSpec(hash PodTemplateSpecHash, spec *v1.PodTemplateSpec) (bool, error) {
+	version := hash.Version()
+	if version == 0 {
+		return false, fmt.Errorf("%q isn't a pod template hash", hash)
+	}
+	expected, err := hashPodTemplateSpecVersion(spec, version)
+	if err != nil {
+		return false, err
+	}
+	if expected == hash {
+		return true, nil
+	}
+
+	// Version 1 hashed the template before it was applied, so a template
+	// from the server only matches once we take its defaults back out.
+	if version == 1 {
+		expected, err = hashPodTemplateSpecV1(serverDefaultsRemoved(spec))
+		if err != nil {
+			return false, err
+		}
+		return expected == hash, nil
+	}
+	return false, nil
+}
+
+// A copy of the template without the defaults the server fills in, in the
+// shape json.Marshal gave the template before it was applied.
+func serverDefaultsRemoved(spec *v1.PodTemplateSpec) *v1.PodTemplateSpec {
+	spec = spec.DeepCopy()
+	stripPodSpecDefaults(&spec.Spec)
+
+	// The server fills in an empty security context, which a template that
+	// was never applied leaves out.
+	if spec.Spec.SecurityContext != nil && reflect.DeepEqual(*spec.Spec.SecurityContext, v1.PodSecurityContext{}) {
+		spec.Spec.SecurityContext = nil
+	}
+	return spec
+}
+
+func hashPodTemplateSpecVersion(spec *v1.PodTemplateSpec, version int) (PodTemplateSpecHash, error) {
+	switch version {
+	case 1:
+		return hashPodTemplateSpecV1(spec)
+	case 2:
+		data, err := canonicalPodTemplateSpec(spec)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		return PodTemplateSpecHash(fmt.Sprintf("v%d-%x", version, sum[:10])), nil
+	}
+	return "", fmt.Errorf("unknown pod template hash version %d", version)
+}
+
+// The original hash: SHA1 of the raw json.Marshal output of the template
+// before it was applied. We added the hash label after hashing, so leave it
+// out when checking old hashes.
+func hashPodTemplateSpecV1(spec *v1.PodTemplateSpec) (PodTemplateSpecHash, error) {
+	spec = withoutHashLabels(spec)
 	data, err := json.Marshal(spec)
 	if err != nil {
 		return "", errors.Wrap(err, "serializing spec to json")
@@ -26,3 +129,192 @@ func HashPodTemplateSpec(spec *v1.PodTemplateSpec) (PodTemplateSpecHash, error)
 	}
 	return PodTemplateSpecHash(fmt.Sprintf("%x", h.Sum(nil)[:10])), nil
 }
+
+// Serializes only what the user wrote: the template's labels, annotations,
+// and spec, minus our hash label, the Deployment controller's hash label,
+// and fields that match their server defaults. Empty values are dropped and
+// keys are sorted, so the result doesn't depend on how the API structs
+// serialize.
+func canonicalPodTemplateSpec(spec *v1.PodTemplateSpec) ([]byte, error) {
+	value, err := canonicalPodTemplateValue(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// json.Marshal sorts map keys.
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "serializing canonical spec")
+	}
+	return data, nil
+}
+
+// The canonical form as decoded JSON, before it's serialized.
+func canonicalPodTemplateValue(spec *v1.PodTemplateSpec) (map[string]interface{}, error) {
+	spec = withoutHashLabels(spec)
+	canonical := &v1.PodTemplateSpec{Spec: spec.Spec}
+	canonical.Labels = spec.Labels
+	canonical.Annotations = spec.Annotations
+	stripPodSpecDefaults(&canonical.Spec)
+
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		return nil, errors.Wrap(err, "serializing spec to json")
+	}
+
+	value := make(map[string]interface{})
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, errors.Wrap(err, "canonicalizing spec")
+	}
+	pruneEmpty(value)
+	return value, nil
+}
+
+// A copy of the template without the labels and annotations that hashes add.
+func withoutHashLabels(spec *v1.PodTemplateSpec) *v1.PodTemplateSpec {
+	spec = spec.DeepCopy()
+	delete(spec.Labels, TiltPodTemplateHashLabel)
+	delete(spec.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	delete(spec.Annotations, TiltPodTemplateFingerprintsAnnotation)
+	return spec
+}
+
+// Drops nulls, empty strings, and empty objects and lists, like an empty
+// securityContext. Keeps false and 0, since a pointer to either usually
+// means something different than leaving the field out. Returns false if
+// the whole value is empty.
+func pruneEmpty(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != ""
+	case []interface{}:
+		if len(v) == 0 {
+			return v, false
+		}
+		for i, elem := range v {
+			// Keep empty elements, so that positions still line up.
+			v[i], _ = pruneEmpty(elem)
+		}
+		return v, true
+	case map[string]interface{}:
+		for key, elem := range v {
+			pruned, ok := pruneEmpty(elem)
+			if !ok {
+				delete(v, key)
+				continue
+			}
+			v[key] = pruned
+		}
+		return v, len(v) > 0
+	}
+	return value, true
+}
+
+// Clears fields that the API server sets to a default when they're empty,
+// so templates hash the same before and after they're applied.
+func stripPodSpecDefaults(spec *v1.PodSpec) {
+	if spec.RestartPolicy == v1.RestartPolicyAlways {
+		spec.RestartPolicy = ""
+	}
+	if spec.DNSPolicy == v1.DNSClusterFirst {
+		spec.DNSPolicy = ""
+	}
+	if spec.SchedulerName == v1.DefaultSchedulerName {
+		spec.SchedulerName = ""
+	}
+	if spec.TerminationGracePeriodSeconds != nil && *spec.TerminationGracePeriodSeconds == v1.DefaultTerminationGracePeriodSeconds {
+		spec.TerminationGracePeriodSeconds = nil
+	}
+
+	for i := range spec.Volumes {
+		source := &spec.Volumes[i].VolumeSource
+		if source.ConfigMap != nil {
+			stripDefaultMode(&source.ConfigMap.DefaultMode)
+		}
+		if source.Secret != nil {
+			stripDefaultMode(&source.Secret.DefaultMode)
+		}
+	}
+
+	for i := range spec.InitContainers {
+		stripContainerDefaults(&spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		stripContainerDefaults(&spec.Containers[i])
+	}
+	for i := range spec.EphemeralContainers {
+		c := &spec.EphemeralContainers[i].EphemeralContainerCommon
+		if c.TerminationMessagePath == v1.TerminationMessagePathDefault {
+			c.TerminationMessagePath = ""
+		}
+		if c.TerminationMessagePolicy == v1.TerminationMessageReadFile {
+			c.TerminationMessagePolicy = ""
+		}
+		if c.ImagePullPolicy == defaultPullPolicy(c.Image) {
+			c.ImagePullPolicy = ""
+		}
+	}
+}
+
+func stripContainerDefaults(c *v1.Container) {
+	if c.TerminationMessagePath == v1.TerminationMessagePathDefault {
+		c.TerminationMessagePath = ""
+	}
+	if c.TerminationMessagePolicy == v1.TerminationMessageReadFile {
+		c.TerminationMessagePolicy = ""
+	}
+	if c.ImagePullPolicy == defaultPullPolicy(c.Image) {
+		c.ImagePullPolicy = ""
+	}
+	for i := range c.Ports {
+		if c.Ports[i].Protocol == v1.ProtocolTCP {
+			c.Ports[i].Protocol = ""
+		}
+	}
+	stripProbeDefaults(c.LivenessProbe)
+	stripProbeDefaults(c.ReadinessProbe)
+	stripProbeDefaults(c.StartupProbe)
+}
+
+func stripProbeDefaults(p *v1.Probe) {
+	if p == nil {
+		return
+	}
+	if p.TimeoutSeconds == 1 {
+		p.TimeoutSeconds = 0
+	}
+	if p.PeriodSeconds == 10 {
+		p.PeriodSeconds = 0
+	}
+	if p.SuccessThreshold == 1 {
+		p.SuccessThreshold = 0
+	}
+	if p.FailureThreshold == 3 {
+		p.FailureThreshold = 0
+	}
+	if p.HTTPGet != nil && p.HTTPGet.Scheme == v1.URISchemeHTTP {
+		p.HTTPGet.Scheme = ""
+	}
+}
+
+func stripDefaultMode(mode **int32) {
+	if *mode != nil && **mode == 0644 {
+		*mode = nil
+	}
+}
+
+// The server pulls images tagged latest, or with no tag, every time.
+func defaultPullPolicy(image string) v1.PullPolicy {
+	if strings.Contains(image, "@") {
+		return v1.PullIfNotPresent
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i == -1 || name[i+1:] == "latest" {
+		return v1.PullAlways
+	}
+	return v1.PullIfNotPresent
+}
@@ -0,0 +1,215 @@
+package tilt
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The template from a manifest, before it's applied.
+func localPodTemplate() *v1.PodTemplateSpec {
+	return &v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "web",
+				Image: "web:1",
+				Ports: []v1.ContainerPort{{ContainerPort: 8080}},
+				ReadinessProbe: &v1.Probe{
+					Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{Path: "/healthz"}},
+				},
+			}},
+			Volumes: []v1.Volume{{
+				Name: "config",
+				VolumeSource: v1.VolumeSource{
+					ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "web"}},
+				},
+			}},
+		},
+	}
+}
+
+// The same template as the server returns it, with defaults filled in.
+func serverPodTemplate() *v1.PodTemplateSpec {
+	gracePeriod := int64(v1.DefaultTerminationGracePeriodSeconds)
+	mode := int32(0644)
+
+	template := localPodTemplate()
+	spec := &template.Spec
+	spec.RestartPolicy = v1.RestartPolicyAlways
+	spec.DNSPolicy = v1.DNSClusterFirst
+	spec.SchedulerName = v1.DefaultSchedulerName
+	spec.TerminationGracePeriodSeconds = &gracePeriod
+	spec.SecurityContext = &v1.PodSecurityContext{}
+	spec.Volumes[0].ConfigMap.DefaultMode = &mode
+
+	c := &spec.Containers[0]
+	c.TerminationMessagePath = v1.TerminationMessagePathDefault
+	c.TerminationMessagePolicy = v1.TerminationMessageReadFile
+	c.ImagePullPolicy = v1.PullIfNotPresent
+	c.Ports[0].Protocol = v1.ProtocolTCP
+	c.ReadinessProbe.TimeoutSeconds = 1
+	c.ReadinessProbe.PeriodSeconds = 10
+	c.ReadinessProbe.SuccessThreshold = 1
+	c.ReadinessProbe.FailureThreshold = 3
+	c.ReadinessProbe.HTTPGet.Scheme = v1.URISchemeHTTP
+	return template
+}
+
+// How version 1 hashed the local template.
+func legacyHash(t *testing.T, spec *v1.PodTemplateSpec) PodTemplateSpecHash {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(data)
+	return PodTemplateSpecHash(fmt.Sprintf("%x", sum[:10]))
+}
+
+func TestPodTemplateHashVersion(t *testing.T) {
+	for _, tc := range []struct {
+		hash    PodTemplateSpecHash
+		version int
+	}{
+		{"0123456789abcdef0123", 1},
+		{"v2-0123456789abcdef0123", 2},
+		{"v12-0123456789abcdef0123", 12},
+		{"5d8f9c7b4", 0},
+		{"v2-xyz", 0},
+		{"", 0},
+	} {
+		if got := tc.hash.Version(); got != tc.version {
+			t.Errorf("expected %q to be version %d, got %d", tc.hash, tc.version, got)
+		}
+	}
+}
+
+func TestHashIgnoresServerDefaults(t *testing.T) {
+	local, err := HashPodTemplateSpec(localPodTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := HashPodTemplateSpec(serverPodTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local != server {
+		t.Errorf("expected the local and server templates to hash the same, got %s and %s", local, server)
+	}
+	if !strings.HasPrefix(string(local), fmt.Sprintf("v%d-", PodTemplateHashVersion)) {
+		t.Errorf("expected a v%d hash, got %s", PodTemplateHashVersion, local)
+	}
+}
+
+func TestHashIgnoresHashLabels(t *testing.T) {
+	before, err := HashPodTemplateSpec(localPodTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := localPodTemplate()
+	template.Labels[TiltPodTemplateHashLabel] = string(before)
+	template.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = "5d8f9c7b4"
+	template.Annotations = map[string]string{TiltPodTemplateFingerprintsAnnotation: "{}"}
+	after, err := HashPodTemplateSpec(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("expected hash labels not to change the hash, got %s and %s", before, after)
+	}
+}
+
+func TestHashChangesWithTemplate(t *testing.T) {
+	before, err := HashPodTemplateSpec(localPodTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := localPodTemplate()
+	template.Spec.Containers[0].Image = "web:2"
+	after, err := HashPodTemplateSpec(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Errorf("expected a new image to change the hash, got %s for both", before)
+	}
+}
+
+func TestCanonicalFormDropsEmptyValues(t *testing.T) {
+	template := localPodTemplate()
+	template.Spec.Containers[0].SecurityContext = &v1.SecurityContext{}
+	data, err := canonicalPodTemplateSpec(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"securityContext", "creationTimestamp", "resources", "protocol"} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("expected no %s in %s", field, data)
+		}
+	}
+
+	// Zero values that were set on purpose stay.
+	zero := int64(0)
+	template.Spec.TerminationGracePeriodSeconds = &zero
+	data, err = canonicalPodTemplateSpec(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"terminationGracePeriodSeconds":0`) {
+		t.Errorf("expected a zero grace period in %s", data)
+	}
+}
+
+func TestMatchesPodTemplateSpec(t *testing.T) {
+	current, err := HashPodTemplateSpec(localPodTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := legacyHash(t, localPodTemplate())
+
+	changed := localPodTemplate()
+	changed.Spec.Containers[0].Image = "web:2"
+
+	for _, tc := range []struct {
+		name     string
+		hash     PodTemplateSpecHash
+		template *v1.PodTemplateSpec
+		want     bool
+	}{
+		{"current hash, local template", current, localPodTemplate(), true},
+		{"current hash, server template", current, serverPodTemplate(), true},
+		{"current hash, changed template", current, changed, false},
+		{"legacy hash, local template", legacy, localPodTemplate(), true},
+		{"legacy hash, server template", legacy, serverPodTemplate(), true},
+		{"legacy hash, changed template", legacy, changed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MatchesPodTemplateSpec(tc.hash, tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchesPodTemplateSpecRejectsUnknownHashes(t *testing.T) {
+	_, err := MatchesPodTemplateSpec("5d8f9c7b4", localPodTemplate())
+	if err == nil {
+		t.Error("expected an error for a hash we didn't compute")
+	}
+	_, err = MatchesPodTemplateSpec("v99-0123456789abcdef0123", localPodTemplate())
+	if err == nil {
+		t.Error("expected an error for a version we don't know")
+	}
+}
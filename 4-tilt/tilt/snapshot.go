@@ -0,0 +1,245 @@
+package tilt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Bump this when the snapshot format changes, so we don't load snapshots
+// written by an older version.
+const snapshotVersion = 2
+
+// A snapshot of the batch cache and the owner trees, so that the next run
+// can start from what this run already listed, then catch up with a watch
+// from the saved resourceVersion instead of listing everything again.
+//
+// The batch cache only has what the selectors matched, so a snapshot is
+// only good for the same selectors.
+type snapshot struct {
+	Version       int                `json:"version"`
+	Cluster       string             `json:"cluster"`
+	LabelSelector string             `json:"labelSelector,omitempty"`
+	FieldSelector string             `json:"fieldSelector,omitempty"`
+	SavedAt       time.Time          `json:"savedAt"`
+	Resources     []snapshotResource `json:"resources"`
+	Trees         []snapshotTree     `json:"trees"`
+}
+
+// Everything we cached for one kind in one namespace.
+type snapshotResource struct {
+	APIVersion      string              `json:"apiVersion"`
+	Kind            string              `json:"kind"`
+	Resource        string              `json:"resource"`
+	Namespace       string              `json:"namespace,omitempty"`
+	ResourceVersion string              `json:"resourceVersion"`
+	Objects         []metav1.ObjectMeta `json:"objects"`
+}
+
+// An owner tree, along with the metadata of the object it's for, so that
+// we notice when the object's owner references change.
+type snapshotTree struct {
+	Tree ObjectRefTree     `json:"tree"`
+	Meta metav1.ObjectMeta `json:"meta"`
+}
+
+// SaveSnapshot writes the batch cache for every kind that's been listed,
+// and every owner tree we've finished looking up.
+//
+// cluster identifies the cluster, e.g., its API server URL. LoadSnapshot
+// refuses snapshots from a different cluster, or with different selectors.
+func (v *OwnerFetcher) SaveSnapshot(w io.Writer, cluster string) error {
+	if v.informers != nil {
+		return fmt.Errorf("snapshots aren't supported with the informer backend")
+	}
+
+	v.mu.Lock()
+	s := snapshot{
+		Version:       snapshotVersion,
+		Cluster:       cluster,
+		LabelSelector: v.cacheOpts.LabelSelector,
+		FieldSelector: v.cacheOpts.FieldSelector,
+		SavedAt:       time.Now(),
+		Trees:         []snapshotTree{},
+	}
+	index := make(map[resourceNamespace]int)
+	for rns, fetch := range v.resourceFetches {
+		switch fetch.status.State {
+		case ResourceCached, ResourceStale, ResourceRestored:
+		default:
+			continue
+		}
+		if fetch.resourceVersion == "" {
+			continue
+		}
+		apiVersion, kind := rns.GVK.ToAPIVersionAndKind()
+		index[rns] = len(s.Resources)
+		s.Resources = append(s.Resources, snapshotResource{
+			APIVersion:      apiVersion,
+			Kind:            kind,
+			Resource:        fetch.gvr.Resource,
+			Namespace:       rns.Namespace,
+			ResourceVersion: fetch.resourceVersion,
+			Objects:         []metav1.ObjectMeta{},
+		})
+	}
+	for _, cached := range v.metaCache {
+		// An object is listed in the namespace it's in, or with every namespace.
+		i, ok := index[resourceNamespace{Namespace: cached.meta.GetNamespace(), GVK: cached.gvk}]
+		if !ok {
+			i, ok = index[resourceNamespace{GVK: cached.gvk}]
+		}
+		if ok {
+			s.Resources[i].Objects = append(s.Resources[i].Objects, *cached.meta)
+		}
+	}
+
+	// Trees that failed are looked up again anyway, and we can only tell
+	// whether a tree is out of date if we know what it was built from.
+	for uid, promise := range v.cache {
+		source, ok := v.sources[uid]
+		if !ok || !promise.isDone() || promise.err != nil || promise.stale {
+			continue
+		}
+		s.Trees = append(s.Trees, snapshotTree{Tree: promise.tree, Meta: *source.meta})
+	}
+	v.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(s)
+}
+
+// LoadSnapshot fills the batch cache from a snapshot. Call it before the
+// first lookup.
+//
+// Lookups use the snapshot as soon as the watch from its resourceVersion
+// opens. If the resourceVersion has expired, we relist. If the watch can't
+// open at all, lookups use the snapshot as if it were stale.
+func (v *OwnerFetcher) LoadSnapshot(r io.Reader, cluster string) error {
+	if v.informers != nil {
+		return fmt.Errorf("snapshots aren't supported with the informer backend")
+	}
+
+	var s snapshot
+	err := json.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return fmt.Errorf("reading owner snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("owner snapshot has version %d, want %d", s.Version, snapshotVersion)
+	}
+	if s.Cluster != cluster {
+		return fmt.Errorf("owner snapshot is for cluster %q, not %q", s.Cluster, cluster)
+	}
+	if s.LabelSelector != v.cacheOpts.LabelSelector || s.FieldSelector != v.cacheOpts.FieldSelector {
+		return fmt.Errorf("owner snapshot is for selectors %q and %q, not %q and %q",
+			s.LabelSelector, s.FieldSelector, v.cacheOpts.LabelSelector, v.cacheOpts.FieldSelector)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return ErrClosed
+	}
+
+	for _, res := range s.Resources {
+		gvk := schema.FromAPIVersionAndKind(res.APIVersion, res.Kind)
+		rns := resourceNamespace{Namespace: res.Namespace, GVK: gvk}
+		if _, ok := v.resourceFetches[rns]; ok {
+			continue
+		}
+
+		for i := range res.Objects {
+			v.cacheMeta(gvk, &res.Objects[i])
+		}
+
+		fetch := &resourceFetch{
+			gvr: gvk.GroupVersion().WithResource(res.Resource),
+			status: ResourceStatus{
+				GVK:       gvk,
+				Namespace: res.Namespace,
+				State:     ResourceRestored,
+				LastSync:  s.SavedAt,
+			},
+			attempt:         make(chan struct{}),
+			resourceVersion: res.ResourceVersion,
+		}
+		v.resourceFetches[rns] = fetch
+
+		rv := res.ResourceVersion
+		v.spawn(func() { v.watchResource(fetch, rv) })
+	}
+
+	// If an object in a tree changed while we weren't watching, the watch
+	// catches up, sees that its owners differ from its source, and forgets
+	// the tree.
+	for i := range s.Trees {
+		t := &s.Trees[i]
+		uid := t.Tree.Ref.UID
+		if _, ok := v.cache[uid]; ok {
+			continue
+		}
+		promise := newObjectTreePromise(nil)
+		promise.visited = nil
+		promise.settle(t.Tree, nil)
+		v.cache[uid] = promise
+		v.sources[uid] = treeSource{ref: t.Tree.Ref, meta: trimMeta(&t.Meta)}
+	}
+	return nil
+}
+
+// SnapshotPath is where to keep the snapshot for a cluster in dir. Each set
+// of selectors gets its own snapshot.
+func (v *OwnerFetcher) SnapshotPath(dir, cluster string) string {
+	key := strings.Join([]string{cluster, v.cacheOpts.LabelSelector, v.cacheOpts.FieldSelector}, "\n")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, fmt.Sprintf("owners-%x.json", sum[:8]))
+}
+
+// SaveSnapshotFile writes a snapshot to path, replacing the old one only
+// once the new one is complete.
+func (v *OwnerFetcher) SaveSnapshotFile(path, cluster string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = v.SaveSnapshot(f, cluster)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshotFile loads a snapshot from path. A missing file isn't an
+// error. There's just nothing to load.
+func (v *OwnerFetcher) LoadSnapshotFile(path, cluster string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return v.LoadSnapshot(f, cluster)
+}
@@ -0,0 +1,69 @@
+package tilt
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSnapshotRestoresTrees(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+	v := newTestOwnerFetcher(t, newTestMapper(), deployment, rs, pod)
+	tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = v.SaveSnapshot(buf, "test-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestMetadataClient(deployment, rs, pod)
+	var lists int64
+	client.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt64(&lists, 1)
+		return false, nil, nil
+	})
+	restored := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+	err = restored.LoadSnapshot(bytes.NewReader(buf.Bytes()), "test-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredTree, err := restored.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredTree.String() != tree.String() {
+		t.Errorf("expected the saved tree:\n%s\ngot:\n%s", tree, restoredTree)
+	}
+	if n := atomic.LoadInt64(&lists); n != 0 {
+		t.Errorf("expected the restored tree without any lists or gets, got %d", n)
+	}
+}
+
+func TestSnapshotIsPerSelector(t *testing.T) {
+	v := newTestOwnerFetcher(t, newTestMapper()).WithCacheOptions(CacheOptions{LabelSelector: "app=a"})
+	buf := &bytes.Buffer{}
+	err := v.SaveSnapshot(buf, "test-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestOwnerFetcher(t, newTestMapper()).WithCacheOptions(CacheOptions{LabelSelector: "app=b"})
+	if v.SnapshotPath("dir", "test-cluster") == other.SnapshotPath("dir", "test-cluster") {
+		t.Errorf("expected each selector to get its own snapshot path")
+	}
+	err = other.LoadSnapshot(buf, "test-cluster")
+	if err == nil || !strings.Contains(err.Error(), "selectors") {
+		t.Errorf("expected a snapshot with other selectors to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package tilt
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Stored next to TiltPodTemplateHashLabel. Annotations, unlike labels, can
+// hold a fingerprint for every part of the template.
+const TiltPodTemplateFingerprintsAnnotation = "tilt.dev/pod-template-fingerprints"
+
+// PodTemplateFingerprints hashes each part of a pod template separately, so
+// that when the template hash changes, we can tell which part changed.
+//
+// The parts are "metadata", "volumes", "spec" for the rest of the pod spec,
+// and one per container, like "container/app" or "initContainer/migrate".
+// Fingerprints use the same canonical form and version prefix as
+// HashPodTemplateSpec.
+type PodTemplateFingerprints map[string]string
+
+// Prefixes for the container parts.
+const (
+	containerPart          = "container/"
+	initContainerPart      = "initContainer/"
+	ephemeralContainerPart = "ephemeralContainer/"
+)
+
+func FingerprintPodTemplateSpec(spec *v1.PodTemplateSpec) (PodTemplateFingerprints, error) {
+	parts, err := podTemplateParts(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(PodTemplateFingerprints, len(parts))
+	for part, value := range parts {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "serializing %s", part)
+		}
+		sum := sha256.Sum256(data)
+		result[part] = fmt.Sprintf("v%d-%x", PodTemplateHashVersion, sum[:10])
+	}
+	return result, nil
+}
+
+// Annotation serializes the fingerprints, to store on a template under
+// TiltPodTemplateFingerprintsAnnotation.
+func (f PodTemplateFingerprints) Annotation() (string, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", errors.Wrap(err, "serializing fingerprints")
+	}
+	return string(data), nil
+}
+
+// The fingerprints stored on a template or pod, or nil if there aren't any.
+func podTemplateFingerprintsOf(annotations map[string]string) (PodTemplateFingerprints, error) {
+	data, ok := annotations[TiltPodTemplateFingerprintsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var result PodTemplateFingerprints
+	err := json.Unmarshal([]byte(data), &result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", TiltPodTemplateFingerprintsAnnotation)
+	}
+	return result, nil
+}
+
+// Whether every fingerprint has the current version, so we can compare them
+// with fingerprints we compute.
+func (f PodTemplateFingerprints) current() bool {
+	prefix := fmt.Sprintf("v%d-", PodTemplateHashVersion)
+	for _, fingerprint := range f {
+		if !strings.HasPrefix(fingerprint, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits the canonical form of a template into the parts we fingerprint.
+func podTemplateParts(spec *v1.PodTemplateSpec) (map[string]interface{}, error) {
+	value, err := canonicalPodTemplateValue(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[string]interface{})
+	if metadata, ok := value["metadata"]; ok {
+		parts["metadata"] = metadata
+	}
+
+	podSpec, _ := value["spec"].(map[string]interface{})
+	for field, prefix := range map[string]string{
+		"containers":          containerPart,
+		"initContainers":      initContainerPart,
+		"ephemeralContainers": ephemeralContainerPart,
+	} {
+		containers, _ := podSpec[field].([]interface{})
+		for _, c := range containers {
+			parts[prefix+nameOf(c)] = c
+		}
+		delete(podSpec, field)
+	}
+
+	if volumes, ok := podSpec["volumes"]; ok {
+		parts["volumes"] = volumes
+		delete(podSpec, "volumes")
+	}
+	if len(podSpec) > 0 {
+		parts["spec"] = podSpec
+	}
+	return parts, nil
+}
+
+// How a part of a template changed.
+type TemplateChange string
+
+const (
+	TemplatePartChanged TemplateChange = "changed"
+	TemplatePartAdded   TemplateChange = "added"
+	TemplatePartRemoved TemplateChange = "removed"
+)
+
+// One part of a template that differs between two templates.
+type TemplatePartDiff struct {
+	Part   string         `json:"part"`
+	Change TemplateChange `json:"change"`
+
+	// The fields within the part that differ, like "image" or
+	// "labels.app", if the templates as they are now differ there too.
+	Fields []string `json:"fields,omitempty"`
+}
+
+func (d TemplatePartDiff) String() string {
+	if len(d.Fields) == 0 {
+		return fmt.Sprintf("%s: %s", d.Part, d.Change)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Part, d.Change, strings.Join(d.Fields, ", "))
+}
+
+// DiffPodTemplates reports which parts of two templates differ.
+//
+// If both templates carry current fingerprints, we trust those, since the
+// templates may have been defaulted or mutated since they were
+// fingerprinted. Otherwise, we fingerprint the templates as they are now.
+//
+// Fields always come from the templates as they are now, so when we trust
+// the stored fingerprints, we only list fields for parts that still differ.
+// Otherwise they'd describe a mutation, not the change.
+func DiffPodTemplates(a, b *v1.PodTemplateSpec) ([]TemplatePartDiff, error) {
+	aParts, err := podTemplateParts(a)
+	if err != nil {
+		return nil, err
+	}
+	bParts, err := podTemplateParts(b)
+	if err != nil {
+		return nil, err
+	}
+	aCurrent, err := FingerprintPodTemplateSpec(a)
+	if err != nil {
+		return nil, err
+	}
+	bCurrent, err := FingerprintPodTemplateSpec(b)
+	if err != nil {
+		return nil, err
+	}
+
+	aPrints, err := podTemplateFingerprintsOf(a.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	bPrints, err := podTemplateFingerprintsOf(b.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	if aPrints == nil || bPrints == nil || !aPrints.current() || !bPrints.current() {
+		aPrints, bPrints = aCurrent, bCurrent
+	}
+
+	names := make(map[string]bool)
+	for part := range aPrints {
+		names[part] = true
+	}
+	for part := range bPrints {
+		names[part] = true
+	}
+
+	result := []TemplatePartDiff{}
+	for part := range names {
+		aPrint, inA := aPrints[part]
+		bPrint, inB := bPrints[part]
+		switch {
+		case !inA:
+			result = append(result, TemplatePartDiff{Part: part, Change: TemplatePartAdded})
+		case !inB:
+			result = append(result, TemplatePartDiff{Part: part, Change: TemplatePartRemoved})
+		case aPrint != bPrint:
+			diff := TemplatePartDiff{Part: part, Change: TemplatePartChanged}
+			if aCurrent[part] != bCurrent[part] {
+				diff.Fields = diffPartFields(part, aParts[part], bParts[part])
+			}
+			result = append(result, diff)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return partOrder(result[i].Part) < partOrder(result[j].Part)
+	})
+	return result, nil
+}
+
+// Sorts metadata first, then the pod spec, volumes, init containers,
+// containers, and ephemeral containers.
+func partOrder(part string) string {
+	switch {
+	case part == "metadata":
+		return "0"
+	case part == "spec":
+		return "1"
+	case part == "volumes":
+		return "2"
+	case strings.HasPrefix(part, initContainerPart):
+		return "3" + part
+	case strings.HasPrefix(part, containerPart):
+		return "4" + part
+	}
+	return "5" + part
+}
+
+// The fields that differ within one part of two templates.
+func diffPartFields(part string, a, b interface{}) []string {
+	switch part {
+	case "metadata":
+		aMeta, _ := a.(map[string]interface{})
+		bMeta, _ := b.(map[string]interface{})
+		var result []string
+		for _, field := range []string{"labels", "annotations"} {
+			result = append(result, diffKeys(field+".", aMeta[field], bMeta[field])...)
+		}
+		return result
+	case "volumes":
+		return diffKeys("", byName(a), byName(b))
+	}
+	return diffKeys("", a, b)
+}
+
+// The keys whose values differ between two JSON objects, sorted.
+func diffKeys(prefix string, a, b interface{}) []string {
+	aMap, _ := a.(map[string]interface{})
+	bMap, _ := b.(map[string]interface{})
+	keys := make(map[string]bool)
+	for key := range aMap {
+		keys[key] = true
+	}
+	for key := range bMap {
+		keys[key] = true
+	}
+
+	result := []string{}
+	for key := range keys {
+		if !reflect.DeepEqual(aMap[key], bMap[key]) {
+			result = append(result, prefix+key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Turns a JSON list of named objects, like volumes, into an object keyed
+// by name.
+func byName(list interface{}) map[string]interface{} {
+	items, _ := list.([]interface{})
+	result := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		result[nameOf(item)] = item
+	}
+	return result
+}
+
+// The name of a JSON object, like a container or a volume.
+func nameOf(item interface{}) string {
+	object, _ := item.(map[string]interface{})
+	name, _ := object["name"].(string)
+	return name
+}
+
+// Where the ServiceAccount admission plugin mounts the token.
+const serviceAccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// PodAsTemplate turns a pod back into the template it was created from, as
+// nearly as we can, so that we can diff pods like templates.
+func PodAsTemplate(pod *v1.Pod) *v1.PodTemplateSpec {
+	spec := pod.Spec.DeepCopy()
+
+	// Set by the scheduler, not the template.
+	spec.NodeName = ""
+
+	// Set by admission plugins, not the template.
+	stripServiceAccountToken(spec)
+	spec.Tolerations = withoutDefaultTolerations(spec.Tolerations)
+	if spec.ServiceAccountName == "default" {
+		spec.ServiceAccountName = ""
+	}
+	if spec.DeprecatedServiceAccount == "default" {
+		spec.DeprecatedServiceAccount = ""
+	}
+	if spec.PriorityClassName == "" {
+		spec.Priority = nil
+		spec.PreemptionPolicy = nil
+	}
+
+	result := &v1.PodTemplateSpec{Spec: *spec}
+	result.Labels = pod.Labels
+	result.Annotations = pod.Annotations
+	return result
+}
+
+// Removes the token volume that the ServiceAccount admission plugin adds,
+// and its mount in every container: a "kube-api-access-" projected volume,
+// or a "-token-" secret on older clusters.
+func stripServiceAccountToken(spec *v1.PodSpec) {
+	tokens := make(map[string]bool)
+	volumes := []v1.Volume{}
+	for _, volume := range spec.Volumes {
+		injected := (volume.Projected != nil && strings.HasPrefix(volume.Name, "kube-api-access-")) ||
+			(volume.Secret != nil && strings.Contains(volume.Secret.SecretName, "-token-"))
+		if injected && mountsAt(spec, volume.Name, serviceAccountMountPath) {
+			tokens[volume.Name] = true
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+	spec.Volumes = volumes
+
+	withoutTokens := func(mounts []v1.VolumeMount) []v1.VolumeMount {
+		result := []v1.VolumeMount{}
+		for _, mount := range mounts {
+			if !tokens[mount.Name] {
+				result = append(result, mount)
+			}
+		}
+		return result
+	}
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].VolumeMounts = withoutTokens(spec.InitContainers[i].VolumeMounts)
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].VolumeMounts = withoutTokens(spec.Containers[i].VolumeMounts)
+	}
+}
+
+// Whether any container mounts a volume at path.
+func mountsAt(spec *v1.PodSpec, volume, path string) bool {
+	containers := append([]v1.Container{}, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+	for _, c := range containers {
+		for _, mount := range c.VolumeMounts {
+			if mount.Name == volume && mount.MountPath == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The DefaultTolerationSeconds admission plugin lets every pod tolerate an
+// unready or unreachable node for 5 minutes.
+func withoutDefaultTolerations(tolerations []v1.Toleration) []v1.Toleration {
+	result := []v1.Toleration{}
+	for _, t := range tolerations {
+		isDefault := (t.Key == v1.TaintNodeNotReady || t.Key == v1.TaintNodeUnreachable) &&
+			t.Operator == v1.TolerationOpExists && t.Effect == v1.TaintEffectNoExecute &&
+			t.TolerationSeconds != nil && *t.TolerationSeconds == 300
+		if !isDefault {
+			result = append(result, t)
+		}
+	}
+	return result
+}
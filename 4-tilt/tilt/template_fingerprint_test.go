@@ -0,0 +1,90 @@
+package tilt
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPodTemplate() *v1.PodTemplateSpec {
+	return &v1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "web", Image: "web:1"}},
+		},
+	}
+}
+
+func TestPodAsTemplateStripsAdmissionFields(t *testing.T) {
+	template := testPodTemplate()
+
+	seconds := int64(300)
+	priority := int32(0)
+	pod := &v1.Pod{ObjectMeta: template.ObjectMeta, Spec: *template.Spec.DeepCopy()}
+	pod.Spec.NodeName = "node-1"
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.DeprecatedServiceAccount = "default"
+	pod.Spec.Priority = &priority
+	pod.Spec.Volumes = []v1.Volume{{
+		Name:         "kube-api-access-x7k2p",
+		VolumeSource: v1.VolumeSource{Projected: &v1.ProjectedVolumeSource{}},
+	}}
+	pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{{
+		Name:      "kube-api-access-x7k2p",
+		MountPath: serviceAccountMountPath,
+		ReadOnly:  true,
+	}}
+	for _, key := range []string{v1.TaintNodeNotReady, v1.TaintNodeUnreachable} {
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, v1.Toleration{
+			Key:               key,
+			Operator:          v1.TolerationOpExists,
+			Effect:            v1.TaintEffectNoExecute,
+			TolerationSeconds: &seconds,
+		})
+	}
+
+	diffs, err := DiffPodTemplates(template, PodAsTemplate(pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected a pod to match its template, got %v", diffs)
+	}
+}
+
+func TestDiffPodTemplatesOmitsFieldsThatNoLongerDiffer(t *testing.T) {
+	old := testPodTemplate()
+	next := testPodTemplate()
+	next.Spec.Containers[0].Image = "web:2"
+	for _, template := range []*v1.PodTemplateSpec{old, next} {
+		prints, err := FingerprintPodTemplateSpec(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotation, err := prints.Annotation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.Annotations = map[string]string{TiltPodTemplateFingerprintsAnnotation: annotation}
+	}
+
+	diffs, err := DiffPodTemplates(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Fields) != 1 || diffs[0].Fields[0] != "image" {
+		t.Errorf("expected the image to change, got %v", diffs)
+	}
+
+	// A webhook pins the old template to the new image. The stored
+	// fingerprints still show the change, but there's no field to blame.
+	old.Spec.Containers[0].Image = "web:2"
+	diffs, err = DiffPodTemplates(old, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Part != containerPart+"web" || len(diffs[0].Fields) != 0 {
+		t.Errorf("expected web to change with no fields, got %v", diffs)
+	}
+}
@@ -0,0 +1,148 @@
+package tilt
+
+import (
+	"log"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// What an owner tree was built from. The meta is trimmed, like the batch
+// cache's.
+type treeSource struct {
+	ref  v1.ObjectReference
+	meta *metav1.ObjectMeta
+}
+
+type subscription struct {
+	ch chan ObjectRefTree
+}
+
+// Sends the newest tree, dropping any older tree the subscriber hasn't
+// received yet.
+func (s *subscription) send(tree ObjectRefTree) {
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- tree:
+	default:
+	}
+}
+
+// Subscribe sends the new owner tree of uid whenever owner references
+// change anywhere in it, e.g., when a pod is orphaned or adopted by a
+// different ReplicaSet.
+//
+// We only notice changes to objects that we watch or that are passed to
+// OwnerTreeOf. If the subscriber falls behind, it only gets the newest tree.
+// The channel is never closed. Call the returned func to unsubscribe.
+func (v *OwnerFetcher) Subscribe(uid types.UID) (<-chan ObjectRefTree, func()) {
+	sub := &subscription{ch: make(chan ObjectRefTree, 1)}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	subs, ok := v.subscriptions[uid]
+	if !ok {
+		subs = make(map[*subscription]bool)
+		v.subscriptions[uid] = subs
+	}
+	subs[sub] = true
+
+	return sub.ch, func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		delete(v.subscriptions[uid], sub)
+		if len(v.subscriptions[uid]) == 0 {
+			delete(v.subscriptions, uid)
+		}
+	}
+}
+
+// Compares the newest version of an object with the one we built its owner
+// tree from, and invalidates every tree it's in if its owners changed.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) checkSource(uid types.UID, meta *metav1.ObjectMeta) {
+	source, ok := v.sources[uid]
+	if !ok || ownerRefsEqual(source.meta.GetOwnerReferences(), meta.GetOwnerReferences()) {
+		return
+	}
+	v.sources[uid] = treeSource{ref: source.ref, meta: trimMeta(meta)}
+	v.invalidate(uid)
+}
+
+// Forgets every cached owner tree that contains uid, and rebuilds the ones
+// with subscribers.
+//
+// In-progress lookups that have already visited uid are marked stale, and
+// settle forgets them instead. Lookups that haven't visited it yet will
+// see the change.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) invalidate(uid types.UID) {
+	for id, promise := range v.cache {
+		if !promise.isDone() {
+			if promise.visited[uid] {
+				promise.stale = true
+			}
+			continue
+		}
+		if !promise.tree.ContainsUID(uid) {
+			continue
+		}
+
+		// Lookups that already got this tree from the promise check
+		// stale, so that their own trees are forgotten too.
+		promise.stale = true
+		delete(v.cache, id)
+		if len(v.subscriptions[id]) > 0 {
+			id := id
+			v.spawn(func() { v.rebuild(id) })
+		}
+	}
+}
+
+// Forgets an object that was deleted, along with what we built its owner
+// tree from, so neither grows without bound.
+//
+// Must hold the lock.
+func (v *OwnerFetcher) forgetDeleted(uid types.UID) {
+	v.uncacheMeta(uid)
+	delete(v.sources, uid)
+}
+
+// Looks up an owner tree again and sends it to the subscribers.
+func (v *OwnerFetcher) rebuild(uid types.UID) {
+	v.mu.Lock()
+	source, ok := v.sources[uid]
+	v.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	tree, err := v.ownerTreeOfMeta(v.globalCtx, source.ref, source.meta)
+	if err != nil {
+		_, isCycle := err.(*CycleError)
+		if !isCycle {
+			log.Printf("Error rebuilding owner tree of %s %s: %v", source.ref.Kind, source.ref.Name, err)
+			return
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for sub := range v.subscriptions[uid] {
+		sub.send(tree)
+	}
+}
+
+func ownerRefsEqual(a, b []metav1.OwnerReference) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,173 @@
+package tilt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func TestDeletesForgetTreeSources(t *testing.T) {
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	rs.Annotations = map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+	client := newTestMetadataClient(deployment, rs, pod)
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.mu.Lock()
+	source, ok := v.sources[rs.UID]
+	v.mu.Unlock()
+	if !ok {
+		t.Fatal("expected the ReplicaSet's tree source")
+	}
+	if len(source.meta.Annotations) != 0 {
+		t.Errorf("expected a trimmed tree source, got annotations %v", source.meta.Annotations)
+	}
+
+	waitForWatch(t, client, "replicasets")
+	err = client.Resource(rs.GroupVersionKind().GroupVersion().WithResource("replicasets")).
+		Namespace("default").Delete(context.Background(), rs.Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the ReplicaSet's tree source to be forgotten", func() bool {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		_, ok := v.sources[rs.UID]
+		return !ok
+	})
+}
+
+func TestSubscribersSeeRebuiltTrees(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		// The ReplicaSet's owners before and after, by Deployment name.
+		before, after []string
+	}{
+		{"Adopted", nil, []string{"app-a"}},
+		{"Orphaned", []string{"app-a"}, nil},
+		{"Owner edited", []string{"app-a"}, []string{"app-b"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			deployments := map[string]*metav1.PartialObjectMetadata{
+				"app-a": newMeta(deploymentGVK, "default", "app-a"),
+				"app-b": newMeta(deploymentGVK, "default", "app-b"),
+			}
+			owned := func(names []string) *metav1.PartialObjectMetadata {
+				rs := newMeta(replicaSetGVK, "default", "app-1")
+				for _, name := range names {
+					addOwner(rs, deployments[name])
+				}
+				return rs
+			}
+			rs := owned(tc.before)
+			pod := newMeta(podGVK, "default", "app-1-a", rs)
+
+			client := newTestMetadataClient(deployments["app-a"], deployments["app-b"], rs, pod)
+			v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+			trees, unsubscribe := v.Subscribe(pod.UID)
+			defer unsubscribe()
+
+			tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertOwners(t, tree, tc.before)
+
+			waitForWatch(t, client, "replicasets")
+			updateMeta(t, client, "replicasets", owned(tc.after))
+
+			select {
+			case tree = <-trees:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the rebuilt tree")
+			}
+			assertOwners(t, tree, tc.after)
+
+			// New lookups see the rebuilt tree too.
+			tree, err = v.OwnerTreeOf(lookupCtx(t), pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertOwners(t, tree, tc.after)
+		})
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	rs := newMeta(replicaSetGVK, "default", "app-1")
+	pod := newMeta(podGVK, "default", "app-1-a", rs)
+	client := newTestMetadataClient(rs, pod)
+	v := newTestOwnerFetcherForClient(t, newTestMapper(), client)
+
+	_, unsubscribe := v.Subscribe(pod.UID)
+	unsubscribe()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.subscriptions) != 0 {
+		t.Errorf("expected no subscriptions, got %v", v.subscriptions)
+	}
+}
+
+// Checks that a pod's tree goes through its ReplicaSet to these Deployments.
+func assertOwners(t *testing.T, tree ObjectRefTree, deployments []string) {
+	t.Helper()
+	if len(tree.Owners) != 1 {
+		t.Fatalf("expected the pod to have a ReplicaSet, got:\n%s", tree)
+	}
+	owners := []string{}
+	for _, owner := range tree.Owners[0].Owners {
+		owners = append(owners, owner.Ref.Name)
+	}
+	if fmt.Sprint(owners) != fmt.Sprint(deployments) {
+		t.Errorf("expected the ReplicaSet to be owned by %v, got:\n%s", deployments, tree)
+	}
+}
+
+// Updates an object in the fake, so its watchers see the change.
+func updateMeta(t *testing.T, client *metadatafake.FakeMetadataClient, resource string, m *metav1.PartialObjectMetadata) {
+	t.Helper()
+	gvr := m.GroupVersionKind().GroupVersion().WithResource(resource)
+	_, err := client.Resource(gvr).Namespace(m.Namespace).(metadatafake.MetadataClient).
+		UpdateFake(m, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Waits until the fake has opened a watch on resource, so that it sees
+// every change after this.
+func waitForWatch(t *testing.T, client *metadatafake.FakeMetadataClient, resource string) {
+	waitFor(t, "a watch on "+resource, func() bool {
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "watch" && action.GetResource().Resource == resource {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,136 @@
+package tilt
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// DOT renders the tree as a Graphviz graph, with an arrow from each owner
+// to the objects it owns.
+func (t ObjectRefTree) DOT() string {
+	g := newRefGraph()
+	g.addOwnerTree(t)
+	return g.dot()
+}
+
+// Mermaid renders the tree as a Mermaid flowchart, with an arrow from each
+// owner to the objects it owns.
+func (t ObjectRefTree) Mermaid() string {
+	g := newRefGraph()
+	g.addOwnerTree(t)
+	return g.mermaid()
+}
+
+// DOT renders the tree as a Graphviz graph, with an arrow from each owner
+// to the objects it owns.
+func (t DescendantTree) DOT() string {
+	g := newRefGraph()
+	g.addDescendantTree(t)
+	return g.dot()
+}
+
+// Mermaid renders the tree as a Mermaid flowchart, with an arrow from each
+// owner to the objects it owns.
+func (t DescendantTree) Mermaid() string {
+	g := newRefGraph()
+	g.addDescendantTree(t)
+	return g.mermaid()
+}
+
+// The objects in a tree, and the owner -> dependent edges between them.
+//
+// An object can appear in a tree more than once, e.g., when it has two
+// owners that share an owner, so we only draw it once.
+type refGraph struct {
+	nodes []v1.ObjectReference
+	notes []string
+	ids   map[string]int
+	edges [][2]int
+	seen  map[[2]int]bool
+}
+
+func newRefGraph() *refGraph {
+	return &refGraph{
+		ids:  make(map[string]int),
+		seen: make(map[[2]int]bool),
+	}
+}
+
+func (g *refGraph) node(ref v1.ObjectReference) int {
+	key := string(ref.UID)
+	if key == "" {
+		key = fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+	}
+	id, ok := g.ids[key]
+	if !ok {
+		id = len(g.nodes)
+		g.ids[key] = id
+		g.nodes = append(g.nodes, ref)
+		g.notes = append(g.notes, "")
+	}
+	return id
+}
+
+// Adds a note to a node's label, e.g., what happens to it.
+func (g *refGraph) annotate(id int, note string) {
+	g.notes[id] = note
+}
+
+func (g *refGraph) edge(owner, dependent int) {
+	e := [2]int{owner, dependent}
+	if !g.seen[e] {
+		g.seen[e] = true
+		g.edges = append(g.edges, e)
+	}
+}
+
+func (g *refGraph) addOwnerTree(t ObjectRefTree) int {
+	id := g.node(t.Ref)
+	for _, owner := range t.Owners {
+		g.edge(g.addOwnerTree(owner), id)
+	}
+	return id
+}
+
+func (g *refGraph) addDescendantTree(t DescendantTree) int {
+	id := g.node(t.Ref)
+	for _, dependent := range t.Dependents {
+		g.edge(id, g.addDescendantTree(dependent))
+	}
+	return id
+}
+
+func (g *refGraph) dot() string {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	lines := []string{"digraph owners {", "  node [shape=box];"}
+	for id, ref := range g.nodes {
+		label := fmt.Sprintf(`%s\n%s`, quote.Replace(ref.Kind), quote.Replace(ref.Name))
+		if g.notes[id] != "" {
+			label += fmt.Sprintf(`\n(%s)`, quote.Replace(g.notes[id]))
+		}
+		lines = append(lines, fmt.Sprintf(`  n%d [label="%s"];`, id, label))
+	}
+	for _, e := range g.edges {
+		lines = append(lines, fmt.Sprintf("  n%d -> n%d;", e[0], e[1]))
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+func (g *refGraph) mermaid() string {
+	quote := strings.NewReplacer(`"`, "#quot;")
+	lines := []string{"graph TD"}
+	for id, ref := range g.nodes {
+		label := fmt.Sprintf("%s: %s", quote.Replace(ref.Kind), quote.Replace(ref.Name))
+		if g.notes[id] != "" {
+			label += fmt.Sprintf(" (%s)", quote.Replace(g.notes[id]))
+		}
+		lines = append(lines, fmt.Sprintf(`  n%d["%s"]`, id, label))
+	}
+	for _, e := range g.edges {
+		lines = append(lines, fmt.Sprintf("  n%d --> n%d", e[0], e[1]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,142 @@
+package tilt
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A pod owned by its ReplicaSet and directly by the ReplicaSet's
+// Deployment, whose name needs escaping in both formats.
+var graphTree = node("Pod", "pod",
+	node("ReplicaSet", "rs", node("Deployment", `say "hi"\now`)),
+	node("Deployment", `say "hi"\now`))
+
+func TestOwnerTreeGraphs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"DOT", graphTree.DOT(), `digraph owners {
+  node [shape=box];
+  n0 [label="Pod\npod"];
+  n1 [label="ReplicaSet\nrs"];
+  n2 [label="Deployment\nsay \"hi\"\\now"];
+  n2 -> n1;
+  n1 -> n0;
+  n2 -> n0;
+}`},
+		{"Mermaid", graphTree.Mermaid(), `graph TD
+  n0["Pod: pod"]
+  n1["ReplicaSet: rs"]
+  n2["Deployment: say #quot;hi#quot;\now"]
+  n2 --> n1
+  n1 --> n0
+  n2 --> n0`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.want, tc.got)
+			}
+		})
+	}
+}
+
+func TestDescendantTreeGraphs(t *testing.T) {
+	tree := DescendantTree{
+		Ref: testRef("Deployment", "app"),
+		Dependents: []DescendantTree{
+			{Ref: testRef("ReplicaSet", "app-1"), Dependents: []DescendantTree{{Ref: testRef("Pod", "app-1-a")}}},
+			{Ref: testRef("ReplicaSet", "app-2")},
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"DOT", tree.DOT(), `digraph owners {
+  node [shape=box];
+  n0 [label="Deployment\napp"];
+  n1 [label="ReplicaSet\napp-1"];
+  n2 [label="Pod\napp-1-a"];
+  n3 [label="ReplicaSet\napp-2"];
+  n1 -> n2;
+  n0 -> n1;
+  n0 -> n3;
+}`},
+		{"Mermaid", tree.Mermaid(), `graph TD
+  n0["Deployment: app"]
+  n1["ReplicaSet: app-1"]
+  n2["Pod: app-1-a"]
+  n3["ReplicaSet: app-2"]
+  n1 --> n2
+  n0 --> n1
+  n0 --> n3`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.want, tc.got)
+			}
+		})
+	}
+}
+
+// Each object is labeled with what happens to it, escaped like the names.
+func TestGCPreviewGraphs(t *testing.T) {
+	preview := GCPreview{
+		Policy: metav1.DeletePropagationBackground,
+		Root: GCNode{
+			Ref:    testRef("Deployment", "app"),
+			Action: GCDelete,
+			Dependents: []GCNode{
+				{
+					Ref:    testRef("ReplicaSet", "app-1"),
+					Action: GCDelete,
+					Dependents: []GCNode{
+						{Ref: testRef("Pod", "app-1-a"), Action: GCDelete},
+						{
+							Ref:         testRef("Pod", "shared"),
+							Action:      GCKeep,
+							OtherOwners: []v1.ObjectReference{testRef("Deployment", `say "hi"`)},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"DOT", preview.DOT(), `digraph owners {
+  node [shape=box];
+  n0 [label="Deployment\napp\n(delete)"];
+  n1 [label="ReplicaSet\napp-1\n(delete)"];
+  n2 [label="Pod\napp-1-a\n(delete)"];
+  n3 [label="Pod\nshared\n(keep, also owned by Deployment:say \"hi\")"];
+  n1 -> n2;
+  n1 -> n3;
+  n0 -> n1;
+}`},
+		{"Mermaid", preview.Mermaid(), `graph TD
+  n0["Deployment: app (delete)"]
+  n1["ReplicaSet: app-1 (delete)"]
+  n2["Pod: app-1-a (delete)"]
+  n3["Pod: shared (keep, also owned by Deployment:say #quot;hi#quot;)"]
+  n1 --> n2
+  n1 --> n3
+  n0 --> n1`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.want, tc.got)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package tilt
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Walk calls fn on the tree and each of its owners, depth first, starting
+// with the object itself at depth 0. If fn returns false, Walk skips the
+// owners of that object.
+//
+// An object with more than one path to the same owner, e.g., a pod owned
+// by both a ReplicaSet and its Deployment, visits the owner once per path.
+func (t ObjectRefTree) Walk(fn func(tree ObjectRefTree, depth int) bool) {
+	t.walk(fn, 0)
+}
+
+func (t ObjectRefTree) walk(fn func(tree ObjectRefTree, depth int) bool, depth int) {
+	if !fn(t, depth) {
+		return
+	}
+	for _, owner := range t.Owners {
+		owner.walk(fn, depth+1)
+	}
+}
+
+// FindByKind returns every object of the given kind in the tree, e.g.,
+// "Deployment", nearest first. Each object is returned once, even if it
+// appears more than once in the tree.
+func (t ObjectRefTree) FindByKind(kind string) []v1.ObjectReference {
+	return t.collect(func(tree ObjectRefTree) bool {
+		return tree.Ref.Kind == kind
+	})
+}
+
+// Roots returns the objects at the top of the tree, i.e., the owners that
+// don't have owners of their own. An object without owners is its own root.
+//
+// Objects that close a cycle have their owners cut off, but they aren't
+// roots.
+func (t ObjectRefTree) Roots() []v1.ObjectReference {
+	return t.collect(func(tree ObjectRefTree) bool {
+		return len(tree.Owners) == 0 && !tree.Cyclic
+	})
+}
+
+// The objects matching fn in breadth-first order, without duplicates.
+func (t ObjectRefTree) collect(fn func(tree ObjectRefTree) bool) []v1.ObjectReference {
+	result := []v1.ObjectReference{}
+	seen := make(map[types.UID]bool)
+	level := []ObjectRefTree{t}
+	for len(level) > 0 {
+		next := []ObjectRefTree{}
+		for _, tree := range level {
+			if fn(tree) && !seen[tree.Ref.UID] {
+				seen[tree.Ref.UID] = true
+				result = append(result, tree.Ref)
+			}
+			next = append(next, tree.Owners...)
+		}
+		level = next
+	}
+	return result
+}
+
+// PathTo returns the chain of owner references from this object to the
+// object with the given UID, including both ends, or nil if the tree
+// doesn't contain it. If there's more than one path, PathTo returns the
+// shortest.
+func (t ObjectRefTree) PathTo(uid types.UID) []v1.ObjectReference {
+	if t.Ref.UID == uid {
+		return []v1.ObjectReference{t.Ref}
+	}
+
+	var shortest []v1.ObjectReference
+	for _, owner := range t.Owners {
+		path := owner.PathTo(uid)
+		if path != nil && (shortest == nil || len(path) < len(shortest)) {
+			shortest = path
+		}
+	}
+	if shortest == nil {
+		return nil
+	}
+	return append([]v1.ObjectReference{t.Ref}, shortest...)
+}
+
+// Depth is the length of the longest chain of owner references in the
+// tree, e.g., 2 for a pod owned by a ReplicaSet owned by a Deployment, and 0
+// for an object without owners.
+func (t ObjectRefTree) Depth() int {
+	depth := 0
+	for _, owner := range t.Owners {
+		if d := owner.Depth() + 1; d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// ControllerChain follows only the owner references with controller=true,
+// e.g., Pod -> ReplicaSet -> Deployment, starting with the object itself.
+//
+// The API server only allows one controller per object, so unlike the rest
+// of the tree, the controllers form a single chain.
+func (t ObjectRefTree) ControllerChain() []v1.ObjectReference {
+	result := []v1.ObjectReference{t.Ref}
+	current := t
+	for {
+		next, ok := current.controller()
+		if !ok {
+			return result
+		}
+		result = append(result, next.Ref)
+		current = next
+	}
+}
+
+func (t ObjectRefTree) controller() (ObjectRefTree, bool) {
+	for _, owner := range t.Owners {
+		if owner.Controller {
+			return owner, true
+		}
+	}
+	return ObjectRefTree{}, false
+}
@@ -0,0 +1,242 @@
+package tilt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testRef(kind, name string) v1.ObjectReference {
+	return v1.ObjectReference{Kind: kind, Name: name, Namespace: "default", UID: types.UID(name + "-uid")}
+}
+
+func node(kind, name string, owners ...ObjectRefTree) ObjectRefTree {
+	return ObjectRefTree{Ref: testRef(kind, name), Owners: owners}
+}
+
+func controlledBy(tree ObjectRefTree) ObjectRefTree {
+	tree.Controller = true
+	return tree
+}
+
+// "Kind:name" for each ref, to keep the tables short.
+func names(refs []v1.ObjectReference) []string {
+	result := []string{}
+	for _, ref := range refs {
+		result = append(result, ref.Kind+":"+ref.Name)
+	}
+	return result
+}
+
+// The trees the query tests share.
+var (
+	// A bare pod.
+	bareTree = node("Pod", "bare")
+
+	// Pod -> ReplicaSet -> Deployment, all controllers.
+	chainTree = node("Pod", "pod",
+		controlledBy(node("ReplicaSet", "rs",
+			controlledBy(node("Deployment", "app")))))
+
+	// A pod owned by its ReplicaSet and by a ConfigMap, which isn't its
+	// controller. The ConfigMap comes first, so ControllerChain must skip it.
+	multiRootTree = node("Pod", "pod",
+		node("ConfigMap", "cfg"),
+		controlledBy(node("ReplicaSet", "rs",
+			controlledBy(node("Deployment", "app")))))
+
+	// A pod owned by its ReplicaSet and directly by the ReplicaSet's
+	// Deployment, so the Deployment appears twice.
+	diamondTree = node("Pod", "pod",
+		controlledBy(node("ReplicaSet", "rs", controlledBy(node("Deployment", "app")))),
+		node("Deployment", "app"))
+
+	// A ReplicaSet whose owner owns it back.
+	cyclicTree = node("Pod", "pod",
+		controlledBy(node("ReplicaSet", "rs",
+			node("Deployment", "app",
+				ObjectRefTree{Ref: testRef("ReplicaSet", "rs"), Cyclic: true}))))
+)
+
+func TestFindByKind(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tree ObjectRefTree
+		kind string
+		want []string
+	}{
+		{"Self", bareTree, "Pod", []string{"Pod:bare"}},
+		{"Missing", bareTree, "Deployment", []string{}},
+		{"Chain", chainTree, "ReplicaSet", []string{"ReplicaSet:rs"}},
+		{"Duplicates", diamondTree, "Deployment", []string{"Deployment:app"}},
+		{"Cycle", cyclicTree, "ReplicaSet", []string{"ReplicaSet:rs"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := names(tc.tree.FindByKind(tc.kind))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRoots(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tree ObjectRefTree
+		want []string
+	}{
+		{"Bare", bareTree, []string{"Pod:bare"}},
+		{"Chain", chainTree, []string{"Deployment:app"}},
+		{"Several roots, nearest first", multiRootTree, []string{"ConfigMap:cfg", "Deployment:app"}},
+		{"Duplicates", diamondTree, []string{"Deployment:app"}},
+		{"Cycle", cyclicTree, []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := names(tc.tree.Roots())
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPathTo(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tree ObjectRefTree
+		to   string
+		want []string
+	}{
+		{"Self", bareTree, "bare", []string{"Pod:bare"}},
+		{"Missing", bareTree, "app", nil},
+		{"Chain", chainTree, "app", []string{"Pod:pod", "ReplicaSet:rs", "Deployment:app"}},
+		{"Shortest", diamondTree, "app", []string{"Pod:pod", "Deployment:app"}},
+		{"Other root", multiRootTree, "cfg", []string{"Pod:pod", "ConfigMap:cfg"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := tc.tree.PathTo(types.UID(tc.to + "-uid"))
+			if tc.want == nil {
+				if path != nil {
+					t.Errorf("expected no path, got %v", names(path))
+				}
+				return
+			}
+			if got := names(path); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDepth(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tree ObjectRefTree
+		want int
+	}{
+		{"Bare", bareTree, 0},
+		{"Chain", chainTree, 2},
+		{"Several roots", multiRootTree, 2},
+		{"Longest path", diamondTree, 2},
+		{"Cycle", cyclicTree, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.tree.Depth(); got != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestControllerChain(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tree ObjectRefTree
+		want []string
+	}{
+		{"Bare", bareTree, []string{"Pod:bare"}},
+		{"Chain", chainTree, []string{"Pod:pod", "ReplicaSet:rs", "Deployment:app"}},
+		{"Skips non-controllers", multiRootTree, []string{"Pod:pod", "ReplicaSet:rs", "Deployment:app"}},
+		{"Stops at a non-controller", cyclicTree, []string{"Pod:pod", "ReplicaSet:rs"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := names(tc.tree.ControllerChain())
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWalk(t *testing.T) {
+	visited := []string{}
+	diamondTree.Walk(func(tree ObjectRefTree, depth int) bool {
+		visited = append(visited, fmt.Sprintf("%d:%s", depth, tree.Ref.Name))
+		return true
+	})
+	want := []string{"0:pod", "1:rs", "2:app", "1:app"}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("expected to visit %v, got %v", want, visited)
+	}
+
+	// Returning false skips the owners.
+	visited = []string{}
+	multiRootTree.Walk(func(tree ObjectRefTree, depth int) bool {
+		visited = append(visited, tree.Ref.Name)
+		return tree.Ref.Kind != "ReplicaSet"
+	})
+	want = []string{"pod", "cfg", "rs"}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("expected to visit %v, got %v", want, visited)
+	}
+}
+
+func TestOwnerTreeOfKeepsReferenceFlags(t *testing.T) {
+	yes := true
+	deployment := newMeta(deploymentGVK, "default", "app")
+	rs := newMeta(replicaSetGVK, "default", "app-1", deployment)
+	rs.OwnerReferences[0].Controller = &yes
+	rs.OwnerReferences[0].BlockOwnerDeletion = &yes
+	other := newMeta(deploymentGVK, "default", "other")
+	pod := newMeta(podGVK, "default", "app-1-a", other, rs)
+	pod.OwnerReferences[1].Controller = &yes
+	v := newTestOwnerFetcher(t, newTestMapper(), deployment, other, rs, pod)
+
+	tree, err := v.OwnerTreeOf(lookupCtx(t), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := []string{}
+	tree.Walk(func(tree ObjectRefTree, depth int) bool {
+		flags = append(flags, fmt.Sprintf("%s controller=%v blockOwnerDeletion=%v",
+			tree.Ref.Name, tree.Controller, tree.BlockOwnerDeletion))
+		return true
+	})
+	want := []string{
+		"app-1-a controller=false blockOwnerDeletion=false",
+		"other controller=false blockOwnerDeletion=false",
+		"app-1 controller=true blockOwnerDeletion=false",
+		"app controller=true blockOwnerDeletion=true",
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(flags, "\n"))
+	}
+	if got := names(tree.ControllerChain()); !reflect.DeepEqual(got, []string{"Pod:app-1-a", "ReplicaSet:app-1", "Deployment:app"}) {
+		t.Errorf("expected the controller chain to skip other, got %v", got)
+	}
+
+	// The ReplicaSet's cached tree is shared, but the flags belong to each
+	// reference, so a lookup from the ReplicaSet itself has none at its root.
+	rsTree, err := v.OwnerTreeOf(lookupCtx(t), rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsTree.Controller || rsTree.BlockOwnerDeletion {
+		t.Errorf("expected no flags at the root, got %+v", rsTree)
+	}
+}
@@ -0,0 +1,231 @@
+package tilt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Where each built-in workload kind keeps its pod template.
+var defaultPodTemplatePaths = map[schema.GroupKind][]string{
+	{Group: "apps", Kind: "Deployment"}:  {"spec", "template"},
+	{Group: "apps", Kind: "StatefulSet"}: {"spec", "template"},
+	{Group: "apps", Kind: "DaemonSet"}:   {"spec", "template"},
+	{Group: "apps", Kind: "ReplicaSet"}:  {"spec", "template"},
+	{Group: "batch", Kind: "Job"}:        {"spec", "template"},
+	{Group: "batch", Kind: "CronJob"}:    {"spec", "jobTemplate", "spec", "template"},
+}
+
+// PodTemplatePaths says where custom resources keep their pod templates,
+// on top of the built-in workload kinds.
+//
+// It's a flag.Value and a pflag.Value, so each flag adds a path in the form
+// KIND.GROUP=JSONPATH, e.g., "MyApp.example.com={.spec.podTemplate}".
+// JSONPaths can only be a chain of fields.
+//
+// In JSON, it's a list of paths in the same form.
+type PodTemplatePaths map[schema.GroupKind][]string
+
+// Each path in the form KIND.GROUP=JSONPATH, sorted.
+func (p PodTemplatePaths) entries() []string {
+	result := []string{}
+	for gk, path := range p {
+		result = append(result, fmt.Sprintf("%s={.%s}", gk, strings.Join(path, ".")))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (p *PodTemplatePaths) String() string {
+	if p == nil || *p == nil {
+		return ""
+	}
+	return strings.Join(p.entries(), ",")
+}
+
+func (p PodTemplatePaths) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.entries())
+}
+
+func (p *PodTemplatePaths) UnmarshalJSON(data []byte) error {
+	var entries []string
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := p.Set(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PodTemplatePaths) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Expected KIND.GROUP=JSONPATH, e.g., MyApp.example.com={.spec.podTemplate}. Got %q", value)
+	}
+	path, err := parseFieldPath(parts[1])
+	if err != nil {
+		return err
+	}
+	if *p == nil {
+		*p = make(PodTemplatePaths)
+	}
+	(*p)[schema.ParseGroupKind(parts[0])] = path
+	return nil
+}
+
+func (p *PodTemplatePaths) Type() string {
+	return "KIND.GROUP=JSONPATH"
+}
+
+// Turns a JSONPath like "{.spec.template}" into a list of fields.
+func parseFieldPath(jsonPath string) ([]string, error) {
+	path := strings.TrimSuffix(strings.TrimPrefix(jsonPath, "{"), "}")
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("JSONPath %q must start with a '.'", jsonPath)
+	}
+	fields := strings.Split(path[1:], ".")
+	for _, field := range fields {
+		if field == "" || strings.ContainsAny(field, "[]*@?()$") {
+			return nil, fmt.Errorf("JSONPath %q can only be a chain of fields, like {.spec.template}", jsonPath)
+		}
+	}
+	return fields, nil
+}
+
+// The path to an object's pod template, and whether it has one.
+func (p PodTemplatePaths) pathFor(gk schema.GroupKind) ([]string, bool) {
+	if path, ok := p[gk]; ok {
+		return path, true
+	}
+	path, ok := defaultPodTemplatePaths[gk]
+	return path, ok
+}
+
+// HasPodTemplate checks whether objects of this kind create pods from a
+// pod template that we know how to find.
+func (p PodTemplatePaths) HasPodTemplate(gk schema.GroupKind) bool {
+	_, ok := p.pathFor(gk)
+	return ok
+}
+
+// The path to a workload's pod template.
+func (p PodTemplatePaths) templatePath(obj *unstructured.Unstructured) ([]string, error) {
+	gk := obj.GroupVersionKind().GroupKind()
+	path, ok := p.pathFor(gk)
+	if !ok {
+		return nil, fmt.Errorf("Don't know where %s keeps its pod template. Add it with KIND.GROUP=JSONPATH", gk)
+	}
+	return path, nil
+}
+
+// PodTemplateOf reads the pod template of a workload.
+//
+// The typed template drops fields this client doesn't know about, so only
+// read it. To change the workload, edit PodTemplateContent, or use
+// SetPodTemplateLabel.
+func (p PodTemplatePaths) PodTemplateOf(obj *unstructured.Unstructured) (*v1.PodTemplateSpec, error) {
+	gk := obj.GroupVersionKind().GroupKind()
+	path, err := p.templatePath(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	content, ok, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s pod template", gk)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s %s has no pod template at {.%s}", gk.Kind, obj.GetName(), strings.Join(path, "."))
+	}
+
+	template := &v1.PodTemplateSpec{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content, template)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s pod template", gk)
+	}
+	return template, nil
+}
+
+// PodTemplateContent returns a workload's pod template as it is in the
+// object, without copying it, so that editing it edits the workload.
+func (p PodTemplatePaths) PodTemplateContent(obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	gk := obj.GroupVersionKind().GroupKind()
+	path, err := p.templatePath(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	content, ok, err := unstructured.NestedFieldNoCopy(obj.Object, path...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s pod template", gk)
+	}
+	template, isMap := content.(map[string]interface{})
+	if !ok || !isMap {
+		return nil, fmt.Errorf("%s %s has no pod template at {.%s}", gk.Kind, obj.GetName(), strings.Join(path, "."))
+	}
+	return template, nil
+}
+
+// SetPodTemplateLabel sets a label on a workload's pod template, leaving
+// the rest of the template alone.
+func (p PodTemplatePaths) SetPodTemplateLabel(obj *unstructured.Unstructured, key, value string) error {
+	return p.setPodTemplateField(obj, value, "metadata", "labels", key)
+}
+
+// SetPodTemplateAnnotation sets an annotation on a workload's pod template,
+// leaving the rest of the template alone.
+func (p PodTemplatePaths) SetPodTemplateAnnotation(obj *unstructured.Unstructured, key, value string) error {
+	return p.setPodTemplateField(obj, value, "metadata", "annotations", key)
+}
+
+func (p PodTemplatePaths) setPodTemplateField(obj *unstructured.Unstructured, value interface{}, fields ...string) error {
+	path, err := p.templatePath(obj)
+	if err != nil {
+		return err
+	}
+	// Copy the path, so we don't append to the one in the map.
+	fields = append(append([]string{}, path...), fields...)
+	return errors.Wrapf(unstructured.SetNestedField(obj.Object, value, fields...),
+		"writing %s pod template", obj.GroupVersionKind().GroupKind())
+}
+
+// InjectPodTemplateHash labels a workload's pod template with its hash, and
+// annotates it with its fingerprints, so that we can trace its pods.
+func (p PodTemplatePaths) InjectPodTemplateHash(obj *unstructured.Unstructured) (PodTemplateSpecHash, error) {
+	template, err := p.PodTemplateOf(obj)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := HashPodTemplateSpec(template)
+	if err != nil {
+		return "", err
+	}
+	fingerprints, err := FingerprintPodTemplateSpec(template)
+	if err != nil {
+		return "", err
+	}
+
+	annotation, err := fingerprints.Annotation()
+	if err != nil {
+		return "", err
+	}
+
+	err = p.SetPodTemplateLabel(obj, TiltPodTemplateHashLabel, string(hash))
+	if err != nil {
+		return "", err
+	}
+	return hash, p.SetPodTemplateAnnotation(obj, TiltPodTemplateFingerprintsAnnotation, annotation)
+}
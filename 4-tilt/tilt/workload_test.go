@@ -0,0 +1,70 @@
+package tilt
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestInjectPodTemplateHashKeepsUnknownFields(t *testing.T) {
+	// spec.os, seccompProfile, and resizePolicy are newer than this client.
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels": map[string]interface{}{"app": "web"},
+				},
+				"spec": map[string]interface{}{
+					"os": map[string]interface{}{"name": "linux"},
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "web",
+							"image": "web:1",
+							"securityContext": map[string]interface{}{
+								"seccompProfile": map[string]interface{}{"type": "RuntimeDefault"},
+							},
+							"resizePolicy": []interface{}{
+								map[string]interface{}{"resourceName": "cpu", "restartPolicy": "NotRequired"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	hash, err := PodTemplatePaths{}.InjectPodTemplateHash(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	label, _, _ := unstructured.NestedString(obj.Object, "spec", "template", "metadata", "labels", TiltPodTemplateHashLabel)
+	if label != string(hash) {
+		t.Errorf("expected hash label %s, got %q", hash, label)
+	}
+	_, ok, _ := unstructured.NestedString(obj.Object, "spec", "template", "metadata", "annotations", TiltPodTemplateFingerprintsAnnotation)
+	if !ok {
+		t.Error("expected a fingerprints annotation")
+	}
+	app, _, _ := unstructured.NestedString(obj.Object, "spec", "template", "metadata", "labels", "app")
+	if app != "web" {
+		t.Errorf("expected the app label to survive, got %q", app)
+	}
+
+	os, _, _ := unstructured.NestedString(obj.Object, "spec", "template", "spec", "os", "name")
+	if os != "linux" {
+		t.Errorf("expected spec.os to survive, got %q", os)
+	}
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	container := containers[0].(map[string]interface{})
+	profile, _, _ := unstructured.NestedString(container, "securityContext", "seccompProfile", "type")
+	if profile != "RuntimeDefault" {
+		t.Errorf("expected seccompProfile to survive, got %q", profile)
+	}
+	if _, ok := container["resizePolicy"]; !ok {
+		t.Error("expected resizePolicy to survive")
+	}
+}
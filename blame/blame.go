@@ -0,0 +1,368 @@
+package blame
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The pipeline records each apply with these annotations, so that we can
+// attribute pods to it later.
+//
+// The Deployment controller copies the Deployment's annotations onto the
+// ReplicaSet it creates, so the apply time and ID are Deployment annotations.
+// The contents go on the pod template, so they're only copied when the
+// template changes.
+const (
+	AppliedAtAnnotation = "tilt.dev/applied-at"
+	DeployIDAnnotation  = "tilt.dev/deploy-id"
+	ContentsAnnotation  = "tilt.dev/contents"
+)
+
+// Annotations that the Deployment controller adds to each ReplicaSet.
+const (
+	revisionAnnotation        = "deployment.kubernetes.io/revision"
+	revisionHistoryAnnotation = "deployment.kubernetes.io/revision-history"
+)
+
+// An Attribution describes the apply that produced a pod.
+type Attribution struct {
+	Pod        v1.ObjectReference
+	Owners     tilt.ObjectRefTree
+	Deployment v1.ObjectReference
+
+	// The ReplicaSet whose pod template produced the pod.
+	ReplicaSet *appsv1.ReplicaSet
+
+	// The tilt.dev/pod-template-hash of the pod, if it has one.
+	PodTemplateHash string
+
+	// The Deployment revision of the ReplicaSet, and any earlier
+	// revisions that applied the same pod template.
+	Revision        int64
+	RevisionHistory []int64
+
+	AppliedAt time.Time
+	DeployID  string
+	Images    []string
+	Contents  string
+
+	// Anything suspicious we noticed along the way, like a pod whose
+	// template hash doesn't match its ReplicaSet.
+	Warnings []string
+}
+
+// Pod walks the owner tree of an existing pod to the Deployment that created it,
+// then finds the ReplicaSet whose pod template matches the pod's template hash.
+func Pod(ctx context.Context, kCli kubernetes.Interface, ownerFetcher *tilt.OwnerFetcher,
+	namespace, name string) (Attribution, error) {
+	pod, err := kCli.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return Attribution{}, err
+	}
+
+	// Typed clients drop the TypeMeta, but the owner tree uses it for the root.
+	pod.Kind = "Pod"
+	pod.APIVersion = "v1"
+
+	tree, err := ownerFetcher.OwnerTreeOf(ctx, pod)
+	_, isCycle := err.(*tilt.CycleError)
+	if err != nil && !isCycle {
+		return Attribution{}, fmt.Errorf("fetching owner tree: %v", err)
+	}
+
+	result := Attribution{
+		Pod:             tree.Ref,
+		Owners:          tree,
+		PodTemplateHash: pod.Labels[tilt.TiltPodTemplateHashLabel],
+	}
+	if isCycle {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Owners are incomplete: %v", err))
+	}
+	for _, status := range ownerFetcher.Status() {
+		if status.State == tilt.ResourceStale {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Owners may be out of date. %s", status))
+		}
+	}
+
+	deployments := tree.FindByKind("Deployment")
+	if len(deployments) == 0 {
+		return result, fmt.Errorf("Pod %s/%s was not created by a Deployment. Owners:\n%s", namespace, name, tree)
+	}
+	deployment := deployments[0]
+	result.Deployment = deployment
+
+	rses, err := kCli.AppsV1().ReplicaSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return result, err
+	}
+
+	rs := matchReplicaSet(rses.Items, deployment.UID, tree, result.PodTemplateHash, &result.Warnings)
+	if rs == nil {
+		return result, fmt.Errorf("No ReplicaSet of Deployment %s matches pod %s", deployment.Name, name)
+	}
+	result.ReplicaSet = rs
+
+	result.Revision, _ = strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+	for _, r := range strings.Split(rs.Annotations[revisionHistoryAnnotation], ",") {
+		revision, err := strconv.ParseInt(r, 10, 64)
+		if err == nil {
+			result.RevisionHistory = append(result.RevisionHistory, revision)
+		}
+	}
+
+	appliedAt := rs.Annotations[AppliedAtAnnotation]
+	if appliedAt != "" {
+		result.AppliedAt, err = time.Parse(time.RFC3339, appliedAt)
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Malformed %s: %v", AppliedAtAnnotation, err))
+		}
+	} else {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("ReplicaSet %s has no %s annotation. Was it applied by kubectl-blame?", rs.Name, AppliedAtAnnotation))
+	}
+	result.DeployID = rs.Annotations[DeployIDAnnotation]
+	result.Contents = rs.Spec.Template.Annotations[ContentsAnnotation]
+	for _, c := range rs.Spec.Template.Spec.Containers {
+		result.Images = append(result.Images, c.Image)
+	}
+	return result, nil
+}
+
+// Descendants finds everything a Deployment created: its ReplicaSets, and
+// their pods.
+func Descendants(ctx context.Context, kCli kubernetes.Interface, ownerFetcher *tilt.OwnerFetcher,
+	namespace, name string) (tilt.DescendantTree, error) {
+	deployment, err := kCli.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return tilt.DescendantTree{}, err
+	}
+
+	ref := v1.ObjectReference{
+		Name:       deployment.Name,
+		Namespace:  deployment.Namespace,
+		Kind:       "Deployment",
+		UID:        deployment.UID,
+		APIVersion: "apps/v1",
+	}
+	return ownerFetcher.DescendantsOf(ctx, ref, tilt.DeploymentDescendantKinds...)
+}
+
+// GCPreview works out what the garbage collector would do if an object were
+// deleted with each of the given propagation policies.
+//
+// target is a resource and name, e.g., "deployment/my-busybox". Dependents
+// are only found if they're one of the dependentResources, e.g., "pods".
+func GCPreview(ctx context.Context, ownerFetcher *tilt.OwnerFetcher, namespace, target string,
+	dependentResources []string, policies []metav1.DeletionPropagation) ([]tilt.GCPreview, error) {
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Expected KIND/NAME, e.g., deployment/my-busybox. Got %q", target)
+	}
+
+	ref, err := ownerFetcher.ResolveRef(ctx, parts[0], namespace, parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := []schema.GroupVersionKind{}
+	for _, resource := range dependentResources {
+		gvk, err := ownerFetcher.ResolveKind(resource)
+		if err != nil {
+			return nil, err
+		}
+		kinds = append(kinds, gvk)
+	}
+
+	result := []tilt.GCPreview{}
+	for _, policy := range policies {
+		preview, err := ownerFetcher.GCPreview(ctx, ref, policy, kinds...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, preview)
+	}
+	return result, nil
+}
+
+// A TemplateDiff describes how the pod templates of two pods or ReplicaSets
+// differ.
+type TemplateDiff struct {
+	From  string                  `json:"from"`
+	To    string                  `json:"to"`
+	Parts []tilt.TemplatePartDiff `json:"parts"`
+}
+
+func (d TemplateDiff) String() string {
+	if len(d.Parts) == 0 {
+		return fmt.Sprintf("%s and %s have the same pod template", d.From, d.To)
+	}
+	lines := []string{fmt.Sprintf("%s -> %s:", d.From, d.To)}
+	for _, part := range d.Parts {
+		lines = append(lines, "  "+part.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffTemplates reports which containers and fields differ between the pod
+// templates of two objects.
+//
+// from and to are each a pod or ReplicaSet and a name, e.g.,
+// "pod/my-busybox-6d4b75cb6d-x7k2p" or "rs/my-busybox-6d4b75cb6d".
+func DiffTemplates(ctx context.Context, kCli kubernetes.Interface, namespace, from, to string) (TemplateDiff, error) {
+	fromTemplate, err := podTemplateOf(ctx, kCli, namespace, from)
+	if err != nil {
+		return TemplateDiff{}, err
+	}
+	toTemplate, err := podTemplateOf(ctx, kCli, namespace, to)
+	if err != nil {
+		return TemplateDiff{}, err
+	}
+
+	parts, err := tilt.DiffPodTemplates(fromTemplate, toTemplate)
+	if err != nil {
+		return TemplateDiff{}, err
+	}
+	return TemplateDiff{From: from, To: to, Parts: parts}, nil
+}
+
+// Fetches the pod template of a pod or ReplicaSet.
+func podTemplateOf(ctx context.Context, kCli kubernetes.Interface, namespace, target string) (*v1.PodTemplateSpec, error) {
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Expected KIND/NAME, e.g., pod/my-busybox-6d4b75cb6d-x7k2p. Got %q", target)
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "pod", "pods", "po":
+		pod, err := kCli.CoreV1().Pods(namespace).Get(ctx, parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return tilt.PodAsTemplate(pod), nil
+	case "replicaset", "replicasets", "rs":
+		rs, err := kCli.AppsV1().ReplicaSets(namespace).Get(ctx, parts[1], metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &rs.Spec.Template, nil
+	}
+	return nil, fmt.Errorf("Can only diff pods and ReplicaSets. Got %q", parts[0])
+}
+
+// Finds the ReplicaSet of the Deployment that produced the pod.
+//
+// If the pod has a template hash, we trust the hash over the owner reference,
+// because ReplicaSets can adopt pods with matching labels.
+func matchReplicaSet(rses []appsv1.ReplicaSet, deploymentUID types.UID, tree tilt.ObjectRefTree,
+	hash string, warnings *[]string) *appsv1.ReplicaSet {
+	var owner *appsv1.ReplicaSet
+	var matches []*appsv1.ReplicaSet
+	for i := range rses {
+		rs := &rses[i]
+		if !isOwnedBy(rs.OwnerReferences, deploymentUID) {
+			continue
+		}
+		if tree.ContainsUID(rs.UID) {
+			owner = rs
+		}
+		if hash != "" && rs.Spec.Template.Labels[tilt.TiltPodTemplateHashLabel] == hash {
+			matches = append(matches, rs)
+		}
+	}
+
+	if hash == "" {
+		*warnings = append(*warnings,
+			fmt.Sprintf("Pod has no %s label, so we can only follow owner references", tilt.TiltPodTemplateHashLabel))
+		return owner
+	}
+
+	if len(matches) == 0 {
+		*warnings = append(*warnings,
+			fmt.Sprintf("No ReplicaSet has pod template hash %s. Falling back to owner references", hash))
+		return owner
+	}
+
+	// Identical templates share a ReplicaSet, so there should only be one
+	// match. If there's more, the newest revision wins.
+	best := matches[0]
+	for _, rs := range matches[1:] {
+		if revisionOf(rs) > revisionOf(best) {
+			best = rs
+		}
+	}
+
+	if owner != nil && owner.UID != best.UID {
+		*warnings = append(*warnings,
+			fmt.Sprintf("Pod is owned by ReplicaSet %s, but its template hash matches ReplicaSet %s. "+
+				"Was it adopted?", owner.Name, best.Name))
+	}
+	return best
+}
+
+func isOwnedBy(refs []metav1.OwnerReference, uid types.UID) bool {
+	for _, ref := range refs {
+		if ref.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func revisionOf(rs *appsv1.ReplicaSet) int64 {
+	revision, _ := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+	return revision
+}
+
+// Print a human-readable report.
+func (a Attribution) Print(w io.Writer) {
+	fmt.Fprintf(w, "Pod:        %s/%s\n", a.Pod.Namespace, a.Pod.Name)
+	fmt.Fprintf(w, "Deployment: %s\n", a.Deployment.Name)
+	if a.ReplicaSet != nil {
+		fmt.Fprintf(w, "ReplicaSet: %s\n", a.ReplicaSet.Name)
+	}
+
+	revision := fmt.Sprintf("%d", a.Revision)
+	if len(a.RevisionHistory) > 0 {
+		history := []string{}
+		for _, r := range a.RevisionHistory {
+			history = append(history, fmt.Sprintf("%d", r))
+		}
+		revision = fmt.Sprintf("%s (same template as %s)", revision, strings.Join(history, ", "))
+	}
+	fmt.Fprintf(w, "Revision:   %s\n", revision)
+
+	if !a.AppliedAt.IsZero() {
+		fmt.Fprintf(w, "Applied at: %s (%s ago)\n", a.AppliedAt.Local().Format(time.RFC3339),
+			time.Since(a.AppliedAt).Round(time.Second))
+	}
+	if a.DeployID != "" {
+		fmt.Fprintf(w, "Deploy ID:  %s\n", a.DeployID)
+	}
+	for _, image := range a.Images {
+		fmt.Fprintf(w, "Image:      %s\n", image)
+	}
+	if a.Contents != "" {
+		fmt.Fprintf(w, "Contents:   %s\n", a.Contents)
+	}
+	if a.PodTemplateHash != "" {
+		fmt.Fprintf(w, "Pod template hash: %s\n", a.PodTemplateHash)
+	}
+
+	fmt.Fprintf(w, "\nOwners:\n%s\n", a.Owners)
+
+	for _, warning := range a.Warnings {
+		fmt.Fprintf(w, "\nWarning: %s\n", warning)
+	}
+}
@@ -0,0 +1,229 @@
+package blame
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/simulation"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// A Deployment as the pipeline applies it, with the tilt strategy's hash.
+func appliedDeployment(image, hash string, appliedAt time.Time) *appsv1.Deployment {
+	labels := map[string]string{"app": "my-busybox"}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-busybox",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AppliedAtAnnotation: appliedAt.Format(time.RFC3339),
+				DeployIDAnnotation:  image,
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "my-busybox", tilt.TiltPodTemplateHashLabel: hash},
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "my-busybox", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+// The pods in the simulated cluster, by the name of their ReplicaSet.
+func podsByReplicaSet(t *testing.T, cluster *simulation.Cluster) map[string][]string {
+	pods, err := cluster.Kube.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string][]string)
+	for _, pod := range pods.Items {
+		for _, owner := range pod.OwnerReferences {
+			result[owner.Name] = append(result[owner.Name], pod.Name)
+		}
+	}
+	return result
+}
+
+func step(t *testing.T, cluster *simulation.Cluster) {
+	err := cluster.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A pod of a ReplicaSet that a newer apply superseded is attributed to the
+// apply that created it, not the latest one.
+func TestPodOfSupersededReplicaSet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cluster := simulation.NewCluster(simulation.SlowStart)
+	firstApply := simulation.Epoch.Add(-time.Hour)
+	_, err := cluster.Apply(appliedDeployment("my-busybox:1", "hash-1", firstApply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step(t, cluster)
+
+	// The old pod isn't available yet, so the new ReplicaSet can't replace it.
+	_, err = cluster.Apply(appliedDeployment("my-busybox:2", "hash-2", simulation.Epoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step(t, cluster)
+
+	rses, err := cluster.Kube.AppsV1().ReplicaSets("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rses.Items) != 2 {
+		t.Fatalf("expected two ReplicaSets, got %d", len(rses.Items))
+	}
+	var oldRS appsv1.ReplicaSet
+	for _, rs := range rses.Items {
+		if rs.Spec.Template.Labels[tilt.TiltPodTemplateHashLabel] == "hash-1" {
+			oldRS = rs
+		}
+	}
+	oldPods := podsByReplicaSet(t, cluster)[oldRS.Name]
+	if len(oldPods) != 1 {
+		t.Fatalf("expected one pod of the old ReplicaSet %s, got %v", oldRS.Name, oldPods)
+	}
+
+	ownerFetcher := cluster.OwnerFetcher(ctx)
+	defer func() { _ = ownerFetcher.Close() }()
+	attribution, err := Pod(ctx, cluster.Kube, ownerFetcher, "default", oldPods[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attribution.ReplicaSet == nil || attribution.ReplicaSet.Name != oldRS.Name {
+		t.Fatalf("expected ReplicaSet %s, got %v", oldRS.Name, attribution.ReplicaSet)
+	}
+	if attribution.Revision != 1 {
+		t.Errorf("expected revision 1, got %d", attribution.Revision)
+	}
+	if !attribution.AppliedAt.Equal(firstApply) {
+		t.Errorf("expected the first apply at %s, got %s", firstApply, attribution.AppliedAt)
+	}
+	if attribution.DeployID != "my-busybox:1" {
+		t.Errorf("expected the first deploy, got %q", attribution.DeployID)
+	}
+	if len(attribution.Images) != 1 || attribution.Images[0] != "my-busybox:1" {
+		t.Errorf("expected the first image, got %v", attribution.Images)
+	}
+	if len(attribution.Warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", attribution.Warnings)
+	}
+}
+
+func TestPodWithNoOwner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cluster := simulation.NewCluster(simulation.Healthy)
+	pod := &v1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default", UID: "standalone-uid"},
+	}
+	err := cluster.Inject(simulation.PodGVR, watch.Added, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ownerFetcher := cluster.OwnerFetcher(ctx)
+	defer func() { _ = ownerFetcher.Close() }()
+	attribution, err := Pod(ctx, cluster.Kube, ownerFetcher, "default", "standalone")
+	if err == nil || !strings.Contains(err.Error(), "was not created by a Deployment") {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+	if attribution.Pod.Name != "standalone" || len(attribution.Owners.Owners) != 0 {
+		t.Errorf("expected the pod with no owners, got:\n%s", attribution.Owners)
+	}
+}
+
+func TestMatchReplicaSet(t *testing.T) {
+	deploymentUID := types.UID("deployment-uid")
+	newRS := func(name, hash, revision string) appsv1.ReplicaSet {
+		return appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				UID:             types.UID(name + "-uid"),
+				Annotations:     map[string]string{revisionAnnotation: revision},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "app", UID: deploymentUID}},
+			},
+			Spec: appsv1.ReplicaSetSpec{
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{tilt.TiltPodTemplateHashLabel: hash}},
+				},
+			},
+		}
+	}
+	old := newRS("app-old", "hash-1", "1")
+	current := newRS("app-current", "hash-2", "2")
+	rollback := newRS("app-rollback", "hash-1", "3")
+	other := newRS("other", "hash-1", "4")
+	other.OwnerReferences[0].UID = "other-deployment-uid"
+
+	// A pod owned by rs.
+	ownedBy := func(rs appsv1.ReplicaSet) tilt.ObjectRefTree {
+		return tilt.ObjectRefTree{
+			Ref:    v1.ObjectReference{Kind: "Pod", Name: "pod", UID: "pod-uid"},
+			Owners: []tilt.ObjectRefTree{{Ref: v1.ObjectReference{Kind: "ReplicaSet", Name: rs.Name, UID: rs.UID}}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		rses    []appsv1.ReplicaSet
+		tree    tilt.ObjectRefTree
+		hash    string
+		want    string
+		warning string
+	}{
+		{"superseded", []appsv1.ReplicaSet{old, current}, ownedBy(old), "hash-1", "app-old", ""},
+		{"adopted", []appsv1.ReplicaSet{old, current}, ownedBy(current), "hash-1", "app-old", "Was it adopted?"},
+		{"no hash", []appsv1.ReplicaSet{old, current}, ownedBy(current), "", "app-current", "can only follow owner references"},
+		{"unknown hash", []appsv1.ReplicaSet{old, current}, ownedBy(current), "hash-3", "app-current", "Falling back to owner references"},
+		{"newest revision wins", []appsv1.ReplicaSet{old, rollback, current}, ownedBy(rollback), "hash-1", "app-rollback", ""},
+		{"other Deployments ignored", []appsv1.ReplicaSet{other, old}, ownedBy(old), "hash-1", "app-old", ""},
+		{"no owner", []appsv1.ReplicaSet{old, current}, ownedBy(appsv1.ReplicaSet{}), "", "", "can only follow owner references"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			warnings := []string{}
+			rs := matchReplicaSet(test.rses, deploymentUID, test.tree, test.hash, &warnings)
+
+			got := ""
+			if rs != nil {
+				got = rs.Name
+			}
+			if got != test.want {
+				t.Errorf("expected ReplicaSet %q, got %q", test.want, got)
+			}
+
+			if test.warning == "" {
+				if len(warnings) != 0 {
+					t.Errorf("expected no warnings, got %v", warnings)
+				}
+				return
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], test.warning) {
+				t.Errorf("expected a warning like %q, got %v", test.warning, warnings)
+			}
+		})
+	}
+}
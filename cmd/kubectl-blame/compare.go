@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+)
+
+type compareCmd struct {
+	opts    pipeline.Options
+	timeout time.Duration
+	record  recordFlag
+
+	metadataInformers bool
+	ownerCache        ownerCacheFlags
+}
+
+func newCompareCmd() *cobra.Command {
+	c := &compareCmd{}
+	cmd := &cobra.Command{
+		Use:   "compare",
+		Short: "Apply one workload and race every strategy against it",
+		Long: `Build, push, and apply a single workload, then track it with every
+strategy at the same time.
+
+When they've all finished, prints a table of when each strategy declared
+success or failure, and which pods it looked at to decide.
+
+Some strategies never declare failure (e.g., helm with --crash), so they
+give up after --timeout.`,
+		Example: `  kubectl blame compare -f ./4-tilt/deployment.yaml
+  kubectl blame compare --crash --timeout=30s
+  kubectl blame compare --crash --record=crash.jsonl`,
+		Args: cobra.NoArgs,
+		RunE: c.run,
+	}
+
+	addPipelineFlags(cmd.Flags(), &c.opts)
+	cmd.Flags().DurationVar(&c.timeout, "timeout", time.Minute,
+		"How long to wait for every strategy to finish")
+	c.record.add(cmd.Flags())
+	addMetadataInformersFlag(cmd.Flags(), &c.metadataInformers)
+	c.ownerCache.add(cmd.Flags())
+	return cmd
+}
+
+func (c *compareCmd) run(cmd *cobra.Command, args []string) error {
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	clients, err := tracker.NewClients(config)
+	if err != nil {
+		return err
+	}
+
+	// Every tracker shares the recording, so it can be replayed with any strategy.
+	clients, err = c.record.wrap(clients)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.record.close() }()
+	if c.metadataInformers {
+		clients = clients.WithMetadataInformers(0)
+	}
+	clients.OwnerCacheDir = c.ownerCache.dir
+	clients.OwnerCacheOptions = c.ownerCache.opts
+
+	ctx := cmd.Context()
+	trackers := []tracker.Tracker{}
+	for _, strategy := range tracker.Strategies {
+		t, err := tracker.New(ctx, strategy, clients)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tracker.Close(t) }()
+
+		// The kubespy table redraws the whole terminal, which would
+		// clobber everyone else's progress.
+		if k, ok := t.(tracker.Kubespy); ok {
+			k.Out = ioutil.Discard
+			t = k
+		}
+		trackers = append(trackers, t)
+	}
+
+	deploys, err := pipeline.Apply(c.opts, trackers...)
+	if err != nil {
+		return err
+	}
+	c.record.recordDeploys(deploys)
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	names := []string{}
+	for _, deploy := range deploys {
+		names = append(names, fmt.Sprintf("%s %s", strings.ToLower(deploy.Kind()), deploy.Name()))
+	}
+	color.Green("[go] racing %s on %s\n",
+		strings.Join(tracker.Strategies, ", "), strings.Join(names, ", "))
+	results := tracker.Compare(ctx, deploys, trackers, func(strategy string, e tracker.Event) {
+		fmt.Printf("[%s] %s\n", strategy, e.Message)
+	})
+
+	fmt.Println()
+	printResults(results)
+	return c.record.close()
+}
+
+func printResults(results []tracker.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATEGY\tRESULT\tTIME\tPODS")
+	for _, r := range results {
+		result := "Success"
+		if r.Err == context.DeadlineExceeded {
+			result = "Timed out"
+		} else if r.Err != nil {
+			result = fmt.Sprintf("Failure: %v", r.Err)
+		}
+
+		pods := strings.Join(r.Pods, ",")
+		if pods == "" {
+			pods = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.3fs\t%s\n", r.Strategy, result, r.Elapsed.Seconds(), pods)
+	}
+	_ = w.Flush()
+}
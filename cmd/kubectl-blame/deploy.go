@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+)
+
+type deployCmd struct {
+	opts     pipeline.Options
+	strategy string
+	timeout  time.Duration
+	record   recordFlag
+
+	metadataInformers bool
+	ownerCache        ownerCacheFlags
+}
+
+func newDeployCmd() *cobra.Command {
+	c := &deployCmd{}
+	cmd := &cobra.Command{
+		Use:   "deploy",
+		Short: "Build, push, and apply a workload, then track it until it's done",
+		Long: `Build and push the image, apply the workload, and track the
+workload's progress.
+
+Each strategy decides when the deploy is done in a different way:
+
+  naive    Creates a random label for each deployment. Watches that label.
+  rollout  Waits for the deployment to report success, like 'kubectl rollout status'.
+  helm     Looks up the replicaset and waits for it to report success, like 'helm --wait'.
+  kubespy  Uses owner references to find everything, like 'kubespy trace'.
+  tilt     Uses a combination of owner references and template hashes, like Tilt.
+
+The rollout and kubespy strategies only track Deployments. The others also
+track StatefulSets, DaemonSets, ReplicaSets, Jobs, CronJobs, and custom
+resources with a --pod-template-path.
+
+A Job's pod template can't change once the Job is created, so delete a Job
+before deploying it again.`,
+		Example: `  kubectl blame deploy --strategy=tilt -f ./4-tilt/deployment.yaml
+  kubectl blame deploy --strategy=tilt -f myapp.yaml --pod-template-path='MyApp.example.com={.spec.podTemplate}'
+  kubectl blame deploy --strategy=naive --contents=hello --crash
+  kubectl blame deploy --strategy=kubespy --record=kubespy.jsonl`,
+		Args: cobra.NoArgs,
+		RunE: c.run,
+	}
+
+	addPipelineFlags(cmd.Flags(), &c.opts)
+	cmd.Flags().StringVar(&c.strategy, "strategy", tracker.StrategyTilt,
+		fmt.Sprintf("How to track the deploy. One of: %s", strings.Join(tracker.Strategies, "|")))
+	cmd.Flags().DurationVar(&c.timeout, "timeout", 0,
+		"How long to wait for the deploy to finish. Zero means wait forever")
+	c.record.add(cmd.Flags())
+	addMetadataInformersFlag(cmd.Flags(), &c.metadataInformers)
+	c.ownerCache.add(cmd.Flags())
+	return cmd
+}
+
+// Flags shared by every command that runs the pipeline.
+func addPipelineFlags(flags *pflag.FlagSet, opts *pipeline.Options) {
+	flags.Int64Var(&opts.Seed, "seed", time.Now().UnixNano(), "Seed the random label generator")
+	flags.StringVar(&opts.Contents, "contents", "", "Contents of index.html. Defaults to the random label")
+	flags.BoolVar(&opts.Crash, "crash", false, "When set, replaces the entrypoint on the container so it crashes")
+	flags.StringVarP(&opts.Filename, "filename", "f", "./deployment.yaml",
+		"Path to the workload to apply: a Deployment, StatefulSet, DaemonSet, ReplicaSet, Job, CronJob, or custom resource")
+	flags.Var(&opts.PodTemplatePaths, "pod-template-path",
+		"Where a custom resource keeps its pod template, as KIND.GROUP=JSONPATH, e.g., MyApp.example.com={.spec.podTemplate}. Repeatable")
+}
+
+func addMetadataInformersFlag(flags *pflag.FlagSet, enabled *bool) {
+	flags.BoolVar(enabled, "metadata-informers", false,
+		"When set, the tilt strategy caches owners with shared metadata informers instead of its own watches")
+}
+
+func (c *deployCmd) run(cmd *cobra.Command, args []string) error {
+	err := validateStrategy(c.strategy)
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	clients, err := tracker.NewClients(config)
+	if err != nil {
+		return err
+	}
+
+	clients, err = c.record.wrap(clients)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.record.close() }()
+	if c.metadataInformers {
+		clients = clients.WithMetadataInformers(0)
+	}
+	clients.OwnerCacheDir = c.ownerCache.dir
+	clients.OwnerCacheOptions = c.ownerCache.opts
+
+	t, err := tracker.New(ctx, c.strategy, clients)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tracker.Close(t) }()
+
+	deploys, err := pipeline.Apply(c.opts, t)
+	if err != nil {
+		return err
+	}
+
+	c.record.recordDeploys(deploys)
+	err = pipeline.Track(ctx, deploys, t)
+	closeErr := c.record.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func validateStrategy(strategy string) error {
+	for _, s := range tracker.Strategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown strategy %q. Must be one of: %s", strategy, strings.Join(tracker.Strategies, "|"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/blame"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"k8s.io/client-go/kubernetes"
+)
+
+type descendantsCmd struct {
+	namespace  string
+	output     outputFlag
+	ownerCache ownerCacheFlags
+}
+
+func newDescendantsCmd() *cobra.Command {
+	c := &descendantsCmd{}
+	cmd := &cobra.Command{
+		Use:   "descendants DEPLOYMENT",
+		Short: "Show everything a Deployment created",
+		Long: `Find every ReplicaSet and pod whose owner references lead back to a
+Deployment, i.e., everything that deploy created.
+
+This is the inverse of 'kubectl blame pod', which walks from a pod up to
+its Deployment.`,
+		Example: `  kubectl blame descendants my-busybox
+  kubectl blame descendants my-busybox -o mermaid`,
+		Args: cobra.ExactArgs(1),
+		RunE: c.run,
+	}
+
+	cmd.Flags().StringVarP(&c.namespace, "namespace", "n", "default", "Namespace of the Deployment")
+	c.output.add(cmd.Flags(), "Output format")
+	c.ownerCache.add(cmd.Flags())
+	return cmd
+}
+
+func (c *descendantsCmd) run(cmd *cobra.Command, args []string) error {
+	err := c.output.validate()
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	kCli, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	ownerFetcher, err := tilt.NewOwnerFetcher(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer c.ownerCache.use(ownerFetcher, config.Host)()
+
+	tree, err := blame.Descendants(ctx, kCli, ownerFetcher, c.namespace, args[0])
+	if err != nil {
+		return err
+	}
+	return c.output.printTree(os.Stdout, tree)
+}
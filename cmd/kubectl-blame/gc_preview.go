@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/blame"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type gcPreviewCmd struct {
+	namespace          string
+	cascade            string
+	dependentResources []string
+	output             outputFlag
+	ownerCache         ownerCacheFlags
+}
+
+func newGCPreviewCmd() *cobra.Command {
+	c := &gcPreviewCmd{}
+	cmd := &cobra.Command{
+		Use:   "gc-preview KIND/NAME",
+		Short: "Show what the garbage collector would delete along with an object",
+		Long: `Before you run 'kubectl delete', find every object whose owner references
+lead back to an object, and show what the garbage collector would do to each
+under foreground, background, and orphan propagation.
+
+An object is only deleted if all of its owners are. With foreground
+propagation, the owner waits for the dependents whose owner reference sets
+blockOwnerDeletion.
+
+Only dependents of the --dependent-resources kinds are found.`,
+		Example: `  kubectl blame gc-preview deployment/my-busybox
+  kubectl blame gc-preview deployment/my-busybox --cascade=foreground -o dot`,
+		Args: cobra.ExactArgs(1),
+		RunE: c.run,
+	}
+
+	policies := []string{}
+	for _, policy := range tilt.GCPolicies {
+		policies = append(policies, strings.ToLower(string(policy)))
+	}
+	cmd.Flags().StringVarP(&c.namespace, "namespace", "n", "default", "Namespace of the object")
+	cmd.Flags().StringVar(&c.cascade, "cascade", "",
+		fmt.Sprintf("Only preview one propagation policy. One of: %s", strings.Join(policies, "|")))
+	cmd.Flags().StringSliceVar(&c.dependentResources, "dependent-resources", []string{"replicasets.apps", "pods"},
+		"The kinds of dependents to look for")
+	c.output.add(cmd.Flags(), "Output format. Formats other than text need --cascade")
+	c.ownerCache.add(cmd.Flags())
+	return cmd
+}
+
+func (c *gcPreviewCmd) run(cmd *cobra.Command, args []string) error {
+	err := c.output.validate()
+	if err != nil {
+		return err
+	}
+
+	policies := tilt.GCPolicies
+	if c.cascade != "" {
+		policy, err := parseCascade(c.cascade)
+		if err != nil {
+			return err
+		}
+		policies = []metav1.DeletionPropagation{policy}
+	} else if !c.output.isText() {
+		return fmt.Errorf("-o %s needs --cascade", c.output.format)
+	}
+
+	ctx := cmd.Context()
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	ownerFetcher, err := tilt.NewOwnerFetcher(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer c.ownerCache.use(ownerFetcher, config.Host)()
+
+	previews, err := blame.GCPreview(ctx, ownerFetcher, c.namespace, args[0], c.dependentResources, policies)
+	if err != nil {
+		return err
+	}
+
+	for i, preview := range previews {
+		if len(previews) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s: deletes %d objects\n", preview.Policy, len(preview.Deleted()))
+		}
+		err := c.output.printTree(os.Stdout, preview)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseCascade(cascade string) (metav1.DeletionPropagation, error) {
+	names := []string{}
+	for _, policy := range tilt.GCPolicies {
+		if strings.EqualFold(string(policy), cascade) {
+			return policy, nil
+		}
+		names = append(names, strings.ToLower(string(policy)))
+	}
+	return "", fmt.Errorf("Unknown cascade %q. Must be one of: %s", cascade, strings.Join(names, "|"))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// kubectl-blame is a kubectl plugin. When this binary is on your PATH,
+// kubectl runs it for `kubectl blame`.
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	err := newRootCmd().ExecuteContext(ctx)
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/pflag"
+	yamlEncoder "sigs.k8s.io/yaml"
+)
+
+// The formats a tree can be printed in.
+var treeFormats = []string{"text", "json", "yaml", "dot", "mermaid"}
+
+// The formats anything else can be printed in.
+var valueFormats = []string{"text", "json", "yaml"}
+
+// A tree that can be printed with -o, i.e., a tilt.ObjectRefTree or
+// tilt.DescendantTree.
+type printableTree interface {
+	fmt.Stringer
+	DOT() string
+	Mermaid() string
+}
+
+type outputFlag struct {
+	format string
+
+	// The formats to accept. nil means treeFormats.
+	formats []string
+}
+
+func (f *outputFlag) add(flags *pflag.FlagSet, usage string) {
+	flags.StringVarP(&f.format, "output", "o", "text",
+		fmt.Sprintf("%s. One of: %s", usage, strings.Join(f.allowed(), "|")))
+}
+
+func (f *outputFlag) allowed() []string {
+	if f.formats == nil {
+		return treeFormats
+	}
+	return f.formats
+}
+
+func (f *outputFlag) validate() error {
+	for _, format := range f.allowed() {
+		if f.format == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown output format %q. Must be one of: %s", f.format, strings.Join(f.allowed(), "|"))
+}
+
+func (f *outputFlag) isText() bool {
+	return f.format == "text"
+}
+
+func (f *outputFlag) printTree(w io.Writer, tree printableTree) error {
+	switch f.format {
+	case "dot":
+		_, err := fmt.Fprintln(w, tree.DOT())
+		return err
+	case "mermaid":
+		_, err := fmt.Fprintln(w, tree.Mermaid())
+		return err
+	default:
+		return f.printValue(w, tree)
+	}
+}
+
+// Prints anything with a text form and a JSON form.
+func (f *outputFlag) printValue(w io.Writer, value fmt.Stringer) error {
+	switch f.format {
+	case "json":
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "yaml":
+		data, err := yamlEncoder.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		_, err := fmt.Fprintln(w, value)
+		return err
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	v1 "k8s.io/api/core/v1"
+)
+
+// A pod and its controller chain, up to a Deployment whose name needs
+// escaping in every format but text.
+var outputTree = tilt.ObjectRefTree{
+	Ref: v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "app-1-a", UID: "pod-uid"},
+	Owners: []tilt.ObjectRefTree{
+		{
+			Ref:        v1.ObjectReference{Kind: "ReplicaSet", Namespace: "default", Name: "app-1", UID: "rs-uid"},
+			Controller: true,
+			Owners: []tilt.ObjectRefTree{
+				{
+					Ref:        v1.ObjectReference{Kind: "Deployment", Namespace: "default", Name: `say "hi"\now`, UID: "deployment-uid"},
+					Controller: true,
+				},
+			},
+		},
+	},
+}
+
+func TestPrintTree(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"text", `Pod:app-1-a
+  ReplicaSet:app-1
+    Deployment:say "hi"\now
+`},
+		{"json", `{
+  "ref": {
+    "kind": "Pod",
+    "namespace": "default",
+    "name": "app-1-a",
+    "uid": "pod-uid"
+  },
+  "owners": [
+    {
+      "ref": {
+        "kind": "ReplicaSet",
+        "namespace": "default",
+        "name": "app-1",
+        "uid": "rs-uid"
+      },
+      "owners": [
+        {
+          "ref": {
+            "kind": "Deployment",
+            "namespace": "default",
+            "name": "say \"hi\"\\now",
+            "uid": "deployment-uid"
+          },
+          "controller": true
+        }
+      ],
+      "controller": true
+    }
+  ]
+}
+`},
+		{"yaml", `owners:
+- controller: true
+  owners:
+  - controller: true
+    ref:
+      kind: Deployment
+      name: say "hi"\now
+      namespace: default
+      uid: deployment-uid
+  ref:
+    kind: ReplicaSet
+    name: app-1
+    namespace: default
+    uid: rs-uid
+ref:
+  kind: Pod
+  name: app-1-a
+  namespace: default
+  uid: pod-uid
+`},
+		{"dot", `digraph owners {
+  node [shape=box];
+  n0 [label="Pod\napp-1-a"];
+  n1 [label="ReplicaSet\napp-1"];
+  n2 [label="Deployment\nsay \"hi\"\\now"];
+  n2 -> n1;
+  n1 -> n0;
+}
+`},
+		{"mermaid", `graph TD
+  n0["Pod: app-1-a"]
+  n1["ReplicaSet: app-1"]
+  n2["Deployment: say #quot;hi#quot;\now"]
+  n2 --> n1
+  n1 --> n0
+`},
+	} {
+		tc := tc
+		t.Run(tc.format, func(t *testing.T) {
+			f := outputFlag{format: tc.format}
+			if err := f.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err := f.printTree(&out, outputTree); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.want, out.String())
+			}
+		})
+	}
+}
+
+func TestOutputFlagRejectsUnknownFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		flag outputFlag
+	}{
+		{"unknown", outputFlag{format: "xml"}},
+		{"graph for a value", outputFlag{format: "dot", formats: valueFormats}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.flag.validate()
+			if err == nil || !strings.Contains(err.Error(), tc.flag.format) {
+				t.Errorf("expected %q to be rejected, got: %v", tc.flag.format, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/pflag"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+)
+
+// Where to keep owner cache snapshots, and how much the owner cache lists
+// and keeps.
+type ownerCacheFlags struct {
+	dir  string
+	opts tilt.CacheOptions
+}
+
+func (f *ownerCacheFlags) add(flags *pflag.FlagSet) {
+	flags.StringVar(&f.dir, "owner-cache-dir", "",
+		"Where to keep snapshots of the owner cache, e.g., ~/.cache/kubectl-blame, so the next run doesn't list everything again. Empty (the default) disables them")
+	flags.Int64Var(&f.opts.PageSize, "owner-cache-page-size", 0,
+		"How many objects the owner cache lists per request. Zero uses the default of 500")
+	flags.StringVar(&f.opts.LabelSelector, "owner-cache-selector", "",
+		"Only cache owners that match this label selector, e.g., app=my-busybox. Others are fetched one at a time")
+	flags.StringVar(&f.opts.FieldSelector, "owner-cache-field-selector", "",
+		"Only cache owners that match this field selector. Others are fetched one at a time")
+	flags.IntVar(&f.opts.MaxObjects, "owner-cache-max-objects", 0,
+		"The most objects the owner cache keeps, evicting the least recently used. Zero means no limit")
+}
+
+// Configures the OwnerFetcher, and warms it from the snapshot for this
+// cluster. Returns a func that saves a new snapshot and closes the
+// OwnerFetcher.
+func (f *ownerCacheFlags) use(ownerFetcher *tilt.OwnerFetcher, cluster string) func() {
+	ownerFetcher.WithCacheOptions(f.opts)
+	if f.dir == "" {
+		return func() { _ = ownerFetcher.Close() }
+	}
+
+	path := ownerFetcher.SnapshotPath(f.dir, cluster)
+	err := ownerFetcher.LoadSnapshotFile(path, cluster)
+	if err != nil {
+		log.Printf("Ignoring owner cache %s: %v", path, err)
+	}
+	return func() {
+		err := ownerFetcher.SaveSnapshotFile(path, cluster)
+		if err != nil {
+			log.Printf("Saving owner cache %s: %v", path, err)
+		}
+		_ = ownerFetcher.Close()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/blame"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"k8s.io/client-go/kubernetes"
+)
+
+type podCmd struct {
+	namespace  string
+	watch      bool
+	output     outputFlag
+	ownerCache ownerCacheFlags
+}
+
+func newPodCmd() *cobra.Command {
+	c := &podCmd{}
+	cmd := &cobra.Command{
+		Use:   "pod NAME",
+		Short: "Find the deploy that created a running pod",
+		Long: `Walk the owner references of a running pod to the Deployment that created it,
+then match the pod's template hash against the Deployment's ReplicaSets to find
+which apply produced the pod: when it was applied, the image, the contents,
+and the Deployment revision.
+
+Apply times and contents are only recorded for Deployments applied by
+'kubectl blame deploy'. Template hashes are only added by the tilt strategy.
+
+With --watch, it prints again whenever an owner's owner references change,
+e.g., when the pod's ReplicaSet is adopted by another Deployment or orphaned.`,
+		Example: `  kubectl blame pod my-busybox-6d4b75cb6d-x7k2p
+  kubectl blame pod my-busybox-6d4b75cb6d-x7k2p --watch
+  kubectl blame pod my-busybox-6d4b75cb6d-x7k2p -o dot | dot -Tpng > owners.png`,
+		Args: cobra.ExactArgs(1),
+		RunE: c.run,
+	}
+
+	cmd.Flags().StringVarP(&c.namespace, "namespace", "n", "default", "Namespace of the pod")
+	cmd.Flags().BoolVarP(&c.watch, "watch", "w", false, "Keep printing whenever the pod's owners change, until interrupted")
+	c.output.add(cmd.Flags(), "Output format. Formats other than text print only the owner tree")
+	c.ownerCache.add(cmd.Flags())
+	return cmd
+}
+
+func (c *podCmd) run(cmd *cobra.Command, args []string) error {
+	err := c.output.validate()
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	kCli, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	ownerFetcher, err := tilt.NewOwnerFetcher(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer c.ownerCache.use(ownerFetcher, config.Host)()
+
+	attribution, err := blame.Pod(ctx, kCli, ownerFetcher, c.namespace, args[0])
+	if err != nil {
+		return err
+	}
+	err = c.print(attribution)
+	if err != nil || !c.watch {
+		return err
+	}
+
+	trees, unsubscribe := ownerFetcher.Subscribe(attribution.Pod.UID)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-trees:
+		}
+
+		// Look up the pod again, since the new owners can change which
+		// apply it came from.
+		attribution, err = blame.Pod(ctx, kCli, ownerFetcher, c.namespace, args[0])
+		if err != nil {
+			return err
+		}
+		err = c.print(attribution)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *podCmd) print(attribution blame.Attribution) error {
+	if !c.output.isText() {
+		return c.output.printTree(os.Stdout, attribution.Owners)
+	}
+	attribution.Print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"github.com/tilt-dev/kubectl-blame-examples/replay"
+	"github.com/tilt-dev/kubectl-blame-examples/simulation"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+)
+
+// How long a tracker has to finish after the last recorded event.
+const replayGracePeriod = 5 * time.Second
+
+type replayCmd struct {
+	strategy string
+	speed    float64
+
+	metadataInformers bool
+}
+
+func newReplayCmd() *cobra.Command {
+	c := &replayCmd{}
+	cmd := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Track a recorded deploy again, without a cluster",
+		Long: `Feed the watch events recorded with 'deploy --record' or 'compare --record'
+into a simulated cluster, and track the recorded Deployment again.
+
+The events arrive in the same order and with the same timing as they did
+in the cluster, so timing-dependent tracker bugs can be reproduced.
+
+A tracker only sees what was recorded, so record with 'compare' to replay
+every strategy. The helm strategy can't be replayed, because Helm talks to
+the cluster itself.`,
+		Example: `  kubectl blame compare --record=crash.jsonl --crash
+  kubectl blame replay crash.jsonl --strategy=tilt --speed=10`,
+		Args: cobra.ExactArgs(1),
+		RunE: c.run,
+	}
+
+	cmd.Flags().StringVar(&c.strategy, "strategy", tracker.StrategyTilt,
+		fmt.Sprintf("How to track the deploy. One of: %s", strings.Join(tracker.Strategies, "|")))
+	cmd.Flags().Float64Var(&c.speed, "speed", 1,
+		"How fast to replay the events. 1 is the recorded speed, 10 is ten times faster")
+	addMetadataInformersFlag(cmd.Flags(), &c.metadataInformers)
+	return cmd
+}
+
+func (c *replayCmd) run(cmd *cobra.Command, args []string) error {
+	err := validateStrategy(c.strategy)
+	if err != nil {
+		return err
+	}
+	if c.strategy == tracker.StrategyHelm {
+		return fmt.Errorf("The helm strategy can't be replayed, because Helm talks to the cluster itself")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	entries, err := replay.Load(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", args[0], err)
+	}
+
+	deploys, err := replay.Deploys(entries)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+
+	cluster := simulation.NewCluster(simulation.Scenario{})
+	clients := cluster.Clients()
+	if c.metadataInformers {
+		clients = clients.WithMetadataInformers(0)
+	}
+	t, err := tracker.New(ctx, c.strategy, clients)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tracker.Close(t) }()
+
+	tracked := make(chan error, 1)
+	go func() {
+		tracked <- pipeline.Track(ctx, deploys, t)
+	}()
+
+	played := make(chan error, 1)
+	go func() {
+		played <- replay.Play(ctx, cluster, entries, c.speed)
+	}()
+
+	select {
+	case err := <-tracked:
+		return err
+	case err := <-played:
+		if err != nil {
+			cancel()
+			<-tracked
+			return err
+		}
+	}
+
+	// The recording is over. Give the tracker a moment to catch up on the
+	// last events.
+	select {
+	case err := <-tracked:
+		return err
+	case <-time.After(replayGracePeriod):
+		cancel()
+		<-tracked
+		return fmt.Errorf("Recording ended before %s finished", c.strategy)
+	}
+}
+
+// When --record is set, records every watch event the trackers see.
+type recordFlag struct {
+	path     string
+	file     *os.File
+	recorder *replay.Recorder
+}
+
+func (r *recordFlag) add(flags *pflag.FlagSet) {
+	flags.StringVar(&r.path, "record", "",
+		"Record every watch event the trackers see to this file, for 'kubectl blame replay'")
+}
+
+// Wraps the clients so that they record to the file.
+func (r *recordFlag) wrap(clients tracker.Clients) (tracker.Clients, error) {
+	if r.path == "" {
+		return clients, nil
+	}
+
+	f, err := os.Create(r.path)
+	if err != nil {
+		return clients, err
+	}
+	r.file = f
+	r.recorder = replay.NewRecorder(f)
+	return r.recorder.Clients(clients), nil
+}
+
+func (r *recordFlag) recordDeploys(deploys []*tracker.Deploy) {
+	if r.recorder == nil {
+		return
+	}
+	for _, deploy := range deploys {
+		r.recorder.RecordDeploy(deploy)
+	}
+}
+
+// Closes the file. Only the first call closes it, so a command can defer a
+// close for its early returns and still check the error of the close at the
+// end.
+func (r *recordFlag) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	if r.recorder.Err() != nil {
+		err = r.recorder.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("recording %s: %v", r.path, err)
+	}
+	return nil
+}
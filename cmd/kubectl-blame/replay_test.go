@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+)
+
+// deploy and compare defer a close for early returns, then close again at
+// the end to check the error.
+func TestRecordFlagClosesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &recordFlag{path: filepath.Join(dir, "events.jsonl")}
+	_, err = r.wrap(tracker.Clients{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.file
+
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.close(); err != nil {
+		t.Errorf("expected the second close to do nothing, got: %v", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Error("expected the file to be closed")
+	}
+}
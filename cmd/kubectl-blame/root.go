@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newRootCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kubectl-blame",
+		Short: "Find out which deploy is responsible for what's running in your cluster",
+		Long: `kubectl-blame is a simplified version of Tilt that's used for teaching and talks.
+
+Install it on your PATH to use it as a kubectl plugin:
+
+  go install ./cmd/kubectl-blame
+  kubectl blame --help`,
+		SilenceUsage: true,
+	}
+
+	cmd.AddCommand(newDeployCmd())
+	cmd.AddCommand(newPodCmd())
+	cmd.AddCommand(newDescendantsCmd())
+	cmd.AddCommand(newGCPreviewCmd())
+	cmd.AddCommand(newTemplateDiffCmd())
+	cmd.AddCommand(newCompareCmd())
+	cmd.AddCommand(newReplayCmd())
+	return cmd
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tilt-dev/kubectl-blame-examples/blame"
+	"github.com/tilt-dev/kubectl-blame-examples/pipeline"
+	"k8s.io/client-go/kubernetes"
+)
+
+type templateDiffCmd struct {
+	namespace string
+	output    outputFlag
+}
+
+func newTemplateDiffCmd() *cobra.Command {
+	c := &templateDiffCmd{output: outputFlag{formats: valueFormats}}
+	cmd := &cobra.Command{
+		Use:   "template-diff KIND/NAME KIND/NAME",
+		Short: "Show which containers and fields differ between two pods or ReplicaSets",
+		Long: `Compare the pod templates of two pods or ReplicaSets, and report which parts
+changed: the metadata, the volumes, the rest of the pod spec, or a container.
+For each changed part, list the fields that differ.
+
+The tilt strategy stores a fingerprint of each part in the
+tilt.dev/pod-template-fingerprints annotation. When both objects have one,
+we compare the fingerprints, so defaults the server added later don't show
+up as changes. Otherwise, we compare the objects as they are now.`,
+		Example: `  kubectl blame template-diff rs/my-busybox-6d4b75cb6d rs/my-busybox-5f8c9d7b4
+  kubectl blame template-diff pod/my-busybox-6d4b75cb6d-x7k2p pod/my-busybox-5f8c9d7b4-q9z8m -o json`,
+		Args: cobra.ExactArgs(2),
+		RunE: c.run,
+	}
+
+	cmd.Flags().StringVarP(&c.namespace, "namespace", "n", "default", "Namespace of the objects")
+	c.output.add(cmd.Flags(), "Output format")
+	return cmd
+}
+
+func (c *templateDiffCmd) run(cmd *cobra.Command, args []string) error {
+	err := c.output.validate()
+	if err != nil {
+		return err
+	}
+
+	config, err := pipeline.Config()
+	if err != nil {
+		return err
+	}
+
+	kCli, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	diff, err := blame.DiffTemplates(cmd.Context(), kCli, c.namespace, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return c.output.printValue(os.Stdout, diff)
+}
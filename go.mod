@@ -15,6 +15,7 @@ require (
 	github.com/pulumi/pulumi-kubernetes v1.6.0
 	github.com/sirupsen/logrus v1.7.0 // indirect
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
 	github.com/tilt-dev/ctlptl v0.2.3-0.20201117045234-19005bb6afa6
 	github.com/tilt-dev/localregistry-go v0.0.0-20201021185044-ffc4c827f097
 	github.com/tjarratt/babble v0.0.0-20191209142150-eecdf8c2339d
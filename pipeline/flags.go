@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"flag"
+	"time"
+)
+
+// ParseFlags parses the command-line flags shared by every sample app.
+func ParseFlags() Options {
+	opts := Options{Filename: "./deployment.yaml"}
+	flag.Int64Var(&opts.Seed, "seed", time.Now().UnixNano(), "Seed the random label generator")
+	flag.StringVar(&opts.Contents, "contents", "", "Contents of index.html. Defaults to the random label")
+	flag.BoolVar(&opts.Crash, "crash", false, "When set, replaces the entrypoint on the container so it crashes")
+	flag.Var(&opts.PodTemplatePaths, "pod-template-path",
+		"Where a custom resource keeps its pod template, as KIND.GROUP=JSONPATH, e.g., MyApp.example.com={.spec.podTemplate}. Repeatable")
+	flag.Parse()
+	return opts
+}
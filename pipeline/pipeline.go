@@ -0,0 +1,527 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	ctlptlapi "github.com/tilt-dev/ctlptl/pkg/api"
+	"github.com/tilt-dev/ctlptl/pkg/cluster"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/blame"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	"github.com/tjarratt/babble"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	yamlEncoder "sigs.k8s.io/yaml"
+)
+
+var alphaRegexp = regexp.MustCompile("[^a-zA-Z-]")
+
+// The name of the image we build. Manifests refer to it by this name, and
+// we replace it with the image we pushed.
+const builtImageName = "my-busybox"
+
+// Options shared by every sample app.
+type Options struct {
+	// Seed for the random label generator.
+	Seed int64
+
+	// Contents of index.html. Defaults to the random label.
+	Contents string
+
+	// When set, replaces the entrypoint on the container so it crashes.
+	Crash bool
+
+	// Path to the manifest. It can have many objects, and we track every
+	// workload among them.
+	//
+	// Jobs are applied like everything else, but a Job's pod template is
+	// immutable, so a Job has to be deleted before it can be deployed again.
+	Filename string
+
+	// Where custom resources in the manifest keep their pod templates.
+	PodTemplatePaths tilt.PodTemplatePaths
+}
+
+// Build and push the image, then apply every object in the manifest, giving
+// each Tracker a chance to modify the workloads first.
+//
+// Returns a Deploy for each applied workload, ready to track.
+func Apply(opts Options, trackers ...tracker.Tracker) ([]*tracker.Deploy, error) {
+	rand.Seed(opts.Seed)
+
+	// Generate a random label for this deployment
+	id := sanitize(babble.NewBabbler().Babble())
+	contentName := opts.Contents
+	if contentName == "" {
+		contentName = id
+	}
+	contents := fmt.Sprintf("Hello world! I'm deployment %s!", contentName)
+	imageTag := fmt.Sprintf("deploy-%x", md5.Sum([]byte(contentName)))
+
+	cl, err := currentCluster()
+	if err != nil {
+		return nil, err
+	}
+	imageRef, err := generateImageRef(cl, imageTag)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the workloads, and point them at the image before we spend time
+	// building it, in case the manifest doesn't use it.
+	objects, err := decodeManifest(opts.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	deploys, workloadIndex := findWorkloads(objects, id, opts.PodTemplatePaths)
+	if len(deploys) == 0 {
+		return nil, fmt.Errorf("%s has no workloads to track, like a Deployment or Job", opts.Filename)
+	}
+
+	err = rewriteImages(deploys, imageRef, opts.Crash)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Filename, err)
+	}
+
+	// Generate the contents of index.html
+	fmt.Printf("Generated index.html = `%s`\n", contents)
+	contentsTarball := tarball(contents)
+
+	// Build + push
+	_, err = cmd(fmt.Sprintf("docker build -t %s -", imageRef),
+		withStdin(contentsTarball))
+	if err != nil {
+		return nil, err
+	}
+
+	if cluster.Product(cl.Product) != cluster.ProductDockerDesktop {
+		_, err = cmd(fmt.Sprintf("docker push %s", imageRef))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Modify the workloads and apply everything
+	for _, deploy := range deploys {
+		err := recordApply(deploy, contents)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range trackers {
+			err := t.Prepare(deploy)
+			if err != nil {
+				return nil, fmt.Errorf("preparing %s: %v", t.Name(), err)
+			}
+		}
+
+		// Trackers can replace the workload, so apply whatever they left.
+		objects[workloadIndex[deploy]] = deploy.Workload
+	}
+
+	data, err := encodeAll(objects)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd("kubectl apply -o yaml -f -", withStdin(data))
+	if err != nil {
+		return nil, withJobHint(err, deploys)
+	}
+
+	results, err := decodeAll(out)
+	if err != nil {
+		return nil, err
+	}
+	err = matchApplied(deploys, workloadIndex, results, len(objects))
+	if err != nil {
+		return nil, err
+	}
+	return deploys, nil
+}
+
+// A Deploy for each workload among the objects, and the index of each
+// workload in objects.
+func findWorkloads(objects []*unstructured.Unstructured, id string, paths tilt.PodTemplatePaths) ([]*tracker.Deploy, map[*tracker.Deploy]int) {
+	deploys := []*tracker.Deploy{}
+	workloadIndex := make(map[*tracker.Deploy]int)
+	for i, obj := range objects {
+		if !paths.HasPodTemplate(obj.GroupVersionKind().GroupKind()) {
+			continue
+		}
+		deploy := &tracker.Deploy{ID: id, Workload: obj, PodTemplatePaths: paths}
+		workloadIndex[deploy] = i
+		deploys = append(deploys, deploy)
+	}
+	return deploys, workloadIndex
+}
+
+// Replaces each workload with what kubectl apply returned for it, so that
+// trackers see its UID and generation.
+//
+// kubectl prints the applied objects in the order we gave them, so the
+// result for a workload is at the workload's index.
+func matchApplied(deploys []*tracker.Deploy, workloadIndex map[*tracker.Deploy]int,
+	results []*unstructured.Unstructured, applied int) error {
+	if len(results) != applied {
+		return fmt.Errorf("kubectl apply returned %d objects, expected %d", len(results), applied)
+	}
+	for _, deploy := range deploys {
+		result := results[workloadIndex[deploy]]
+		if result.GetKind() != deploy.Kind() || result.GetName() != deploy.Name() {
+			return fmt.Errorf("kubectl apply returned %s %s, expected %s %s",
+				result.GetKind(), result.GetName(), deploy.Kind(), deploy.Name())
+		}
+		deploy.Workload = result
+	}
+	return nil
+}
+
+// A Job's pod template is immutable, and every deploy changes it, so
+// applying a Job that already exists always fails. We don't delete the old
+// Job for you, since it may still be running.
+func withJobHint(err error, deploys []*tracker.Deploy) error {
+	jobs := []string{}
+	for _, deploy := range deploys {
+		if deploy.Workload.GroupVersionKind().GroupKind() == (schema.GroupKind{Group: "batch", Kind: "Job"}) {
+			jobs = append(jobs, "job/"+deploy.Name())
+		}
+	}
+	if len(jobs) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v. A Job's pod template can't change once it's created, "+
+		"so delete %s before deploying it again", err, strings.Join(jobs, ", "))
+}
+
+// A container in a pod template: a container, an init container, or an
+// ephemeral container.
+//
+// fields is the container as it is in the workload, so that we can point it
+// at another image without dropping fields this client doesn't know about.
+type templateContainer struct {
+	kind   string
+	name   string
+	fields map[string]interface{}
+}
+
+func (c templateContainer) image() string {
+	image, _ := c.fields["image"].(string)
+	return image
+}
+
+func containersOf(template map[string]interface{}) ([]templateContainer, error) {
+	result := []templateContainer{}
+	for _, list := range []struct{ kind, field string }{
+		{"initContainer", "initContainers"},
+		{"container", "containers"},
+		{"ephemeralContainer", "ephemeralContainers"},
+	} {
+		containers, _, err := unstructured.NestedFieldNoCopy(template, "spec", list.field)
+		if err != nil {
+			return nil, err
+		}
+		items, _ := containers.([]interface{})
+		for _, item := range items {
+			fields, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("spec.%s has a %T, expected a container", list.field, item)
+			}
+			name, _ := fields["name"].(string)
+			result = append(result, templateContainer{list.kind, name, fields})
+		}
+	}
+	return result, nil
+}
+
+// Points every container that runs the image we build at the image we
+// pushed, and reports the containers we left alone, like a database next
+// to the app or an init container that runs busybox.
+//
+// Fails if no container runs the image we build, since there'd be nothing
+// to deploy.
+func rewriteImages(deploys []*tracker.Deploy, imageRef string, crash bool) error {
+	rewritten := 0
+	for _, deploy := range deploys {
+		template, err := deploy.PodTemplatePaths.PodTemplateContent(deploy.Workload)
+		if err != nil {
+			return err
+		}
+		containers, err := containersOf(template)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", deploy.Kind(), deploy.Name(), err)
+		}
+
+		workload := fmt.Sprintf("%s/%s", strings.ToLower(deploy.Kind()), deploy.Name())
+		for _, c := range containers {
+			if !isBuiltImage(c.image()) {
+				fmt.Printf("[go] Leaving %s %s %s on image %s\n", workload, c.kind, c.name, c.image())
+				continue
+			}
+
+			fmt.Printf("[go] Setting %s %s %s to image %s\n", workload, c.kind, c.name, imageRef)
+			c.fields["image"] = imageRef
+			rewritten++
+
+			if crash && c.kind == "container" {
+				fmt.Printf("[go] Adding command = [\"sh\", \"-c\", \"exit 1\"] to %s %s because --crash=true\n", workload, c.name)
+				c.fields["command"] = []interface{}{"sh", "-c", "exit 1"}
+			}
+		}
+	}
+
+	if rewritten == 0 {
+		return fmt.Errorf("No container uses image %s, so there's nowhere to deploy the image we built", builtImageName)
+	}
+	return nil
+}
+
+// Records the apply on a workload, so that `kubectl blame pod` can find it
+// later.
+func recordApply(deploy *tracker.Deploy, contents string) error {
+	annotations := deploy.Workload.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[blame.AppliedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	annotations[blame.DeployIDAnnotation] = deploy.ID
+	deploy.Workload.SetAnnotations(annotations)
+	return deploy.PodTemplatePaths.SetPodTemplateAnnotation(deploy.Workload, blame.ContentsAnnotation, contents)
+}
+
+// Whether an image in the manifest refers to the image we build, e.g.,
+// "my-busybox" or "my-busybox:latest".
+func isBuiltImage(image string) bool {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.IndexAny(name, ":@"); i != -1 {
+		name = name[:i]
+	}
+	return name == builtImageName
+}
+
+// Apply the workloads, then track them until they're done, printing progress.
+func Run(ctx context.Context, opts Options, t tracker.Tracker) error {
+	deploys, err := Apply(opts, t)
+	if err != nil {
+		return err
+	}
+	return Track(ctx, deploys, t)
+}
+
+// Track applied workloads until they're all done, printing progress.
+//
+// When there's more than one workload, each line of progress says which
+// workload it's about.
+func Track(ctx context.Context, deploys []*tracker.Deploy, t tracker.Tracker) error {
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(deploys))
+	for i, deploy := range deploys {
+		i, deploy := i, deploy
+		prefix := ""
+		if len(deploys) > 1 {
+			prefix = fmt.Sprintf("[%s/%s] ", strings.ToLower(deploy.Kind()), deploy.Name())
+		}
+
+		color.Green("[go] %s: tracking %s %s\n", t.Name(), strings.ToLower(deploy.Kind()), deploy.Name())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = t.Track(ctx, deploy, func(e tracker.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Println(prefix + e.Message)
+			})
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			if len(deploys) > 1 {
+				err = fmt.Errorf("%s %s: %v", deploys[i].Kind(), deploys[i].Name(), err)
+			}
+			color.Red("Failure: %v", err)
+			return err
+		}
+	}
+	color.Green("Success")
+	return nil
+}
+
+func sanitize(s string) string {
+	return strings.ToLower(alphaRegexp.ReplaceAllString(s, ""))
+}
+
+func generateImageRef(c *ctlptlapi.Cluster, tag string) (string, error) {
+	// If this is docker-desktop, we don't need to rename or push the image.
+	if cluster.Product(c.Product) == cluster.ProductDockerDesktop {
+		return fmt.Sprintf("%s:%s", builtImageName, tag), nil
+	}
+
+	// If this cluster advertises a registry, push there.
+	registry := c.Status.LocalRegistryHosting
+	if registry != nil && registry.Host != "" {
+		imageName := path.Join(registry.Host, builtImageName)
+		return fmt.Sprintf("%s:%s", imageName, tag), nil
+	}
+
+	return "", fmt.Errorf("This script requires Docker Desktop or a cluster with a discoverable registry.\n" +
+		"See https://github.com/tilt-dev/ctlptl for help on how to set up a cluster with a registry.")
+}
+
+func tarball(contents string) io.Reader {
+	b := bytes.NewBuffer(nil)
+	w := tar.NewWriter(b)
+	dockerfile := []byte(`
+FROM busybox
+ADD index.html index.html
+ENTRYPOINT busybox httpd -f -p 8000
+`)
+	_ = w.WriteHeader(&tar.Header{
+		Name: "Dockerfile",
+		Mode: 0644,
+		Uid:  0,
+		Gid:  0,
+		Size: int64(len(dockerfile)),
+	})
+
+	_, _ = w.Write(dockerfile)
+
+	_ = w.WriteHeader(&tar.Header{
+		Name: "index.html",
+		Mode: 0644,
+		Uid:  0,
+		Gid:  0,
+		Size: int64(len([]byte(contents))),
+	})
+	_, _ = w.Write([]byte(contents))
+	_ = w.Close()
+	return b
+}
+
+// Decodes every object in a multi-document manifest, flattening Lists.
+func decodeManifest(path string) ([]*unstructured.Unstructured, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := decodeAll(contents)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return objects, nil
+}
+
+func decodeAll(b []byte) ([]*unstructured.Unstructured, error) {
+	result := []*unstructured.Unstructured{}
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer(b), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		err := decoder.Decode(&obj.Object)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip empty documents, e.g., after a trailing ---.
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if !obj.IsList() {
+			result = append(result, obj)
+			continue
+		}
+		list, err := obj.ToList()
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			result = append(result, &list.Items[i])
+		}
+	}
+}
+
+// Encodes objects as a multi-document YAML manifest.
+func encodeAll(objects []*unstructured.Unstructured) (io.Reader, error) {
+	b := bytes.NewBuffer(nil)
+	for _, obj := range objects {
+		data, err := yamlEncoder.Marshal(obj.Object)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString("---\n")
+		b.Write(data)
+	}
+	return b, nil
+}
+
+type cmdOption func(*exec.Cmd)
+
+func withStdin(r io.Reader) cmdOption {
+	return func(cmd *exec.Cmd) {
+		cmd.Stdin = r
+	}
+}
+
+func cmd(s string, options ...cmdOption) ([]byte, error) {
+	fmt.Println(s)
+	cmd := exec.Command("bash", "-c", s)
+	for _, o := range options {
+		o(cmd)
+	}
+	stdout, err := cmd.Output()
+	if err != nil {
+		exitErr, isExitError := err.(*exec.ExitError)
+		if isExitError {
+			fmt.Println("Stderr: ", string(exitErr.Stderr))
+		}
+		return nil, err
+	}
+	return stdout, nil
+}
+
+// Config loads the client config from the default kubeconfig.
+func Config() (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.DefaultClientConfig = &clientcmd.DefaultClientConfig
+
+	overrides := &clientcmd.ConfigOverrides{}
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	return loader.ClientConfig()
+}
+
+func currentCluster() (*ctlptlapi.Cluster, error) {
+	c, err := cluster.DefaultController(genericclioptions.IOStreams{
+		Out:    os.Stdout,
+		ErrOut: os.Stderr,
+		In:     os.Stdin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.Current(context.Background())
+}
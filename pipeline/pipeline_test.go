@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRewriteImagesKeepsUnknownFields(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"os": map[string]interface{}{"name": "linux"},
+					"initContainers": []interface{}{
+						map[string]interface{}{"name": "migrate", "image": builtImageName},
+						map[string]interface{}{"name": "wait", "image": "busybox"},
+					},
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "web",
+							"image": builtImageName + ":latest",
+							"resizePolicy": []interface{}{
+								map[string]interface{}{"resourceName": "cpu", "restartPolicy": "NotRequired"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	err := rewriteImages([]*tracker.Deploy{{ID: "test", Workload: obj}}, "localhost:5000/my-busybox:abc", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec", "template", "spec")
+	if _, ok := spec["os"]; !ok {
+		t.Error("expected spec.os to survive")
+	}
+	inits := spec["initContainers"].([]interface{})
+	if image := inits[0].(map[string]interface{})["image"]; image != "localhost:5000/my-busybox:abc" {
+		t.Errorf("expected the migrate init container on the built image, got %v", image)
+	}
+	if image := inits[1].(map[string]interface{})["image"]; image != "busybox" {
+		t.Errorf("expected the wait init container left on busybox, got %v", image)
+	}
+	web := spec["containers"].([]interface{})[0].(map[string]interface{})
+	if web["image"] != "localhost:5000/my-busybox:abc" {
+		t.Errorf("expected web on the built image, got %v", web["image"])
+	}
+	if _, ok := web["resizePolicy"]; !ok {
+		t.Error("expected resizePolicy to survive")
+	}
+	command, _, _ := unstructured.NestedStringSlice(web, "command")
+	if len(command) != 3 || command[2] != "exit 1" {
+		t.Errorf("expected --crash to set the command, got %v", command)
+	}
+}
+
+const mixedManifest = `
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: my-busybox
+---
+---
+# Only a comment.
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: web-config
+- apiVersion: batch/v1
+  kind: Job
+  metadata:
+    name: migrate
+  spec:
+    template:
+      spec:
+        containers:
+        - name: migrate
+          image: my-busybox
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+`
+
+func TestDecodeAllFlattensLists(t *testing.T) {
+	objects, err := decodeAll([]byte(mixedManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, obj := range objects {
+		got = append(got, obj.GetKind()+"/"+obj.GetName())
+	}
+	want := []string{"Deployment/web", "ConfigMap/web-config", "Job/migrate", "Service/web"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestMatchApplied(t *testing.T) {
+	// What kubectl apply returns for each object: the same objects in the
+	// same order, now with UIDs.
+	applied := func(t *testing.T, objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+		data, err := encodeAll(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := decodeAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			result.SetUID(types.UID(result.GetName() + "-uid"))
+		}
+		return results
+	}
+
+	tests := []struct {
+		name string
+
+		// Changes what kubectl apply returned.
+		edit    func(results []*unstructured.Unstructured) []*unstructured.Unstructured
+		wantErr string
+	}{
+		{
+			name: "in order",
+			edit: func(results []*unstructured.Unstructured) []*unstructured.Unstructured { return results },
+		},
+		{
+			name: "missing an object",
+			edit: func(results []*unstructured.Unstructured) []*unstructured.Unstructured {
+				return results[:len(results)-1]
+			},
+			wantErr: "kubectl apply returned 3 objects, expected 4",
+		},
+		{
+			name: "out of order",
+			edit: func(results []*unstructured.Unstructured) []*unstructured.Unstructured {
+				results[0], results[2] = results[2], results[0]
+				return results
+			},
+			wantErr: "kubectl apply returned Job migrate, expected Deployment web",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			objects, err := decodeAll([]byte(mixedManifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deploys, workloadIndex := findWorkloads(objects, "test", nil)
+			if len(deploys) != 2 || deploys[0].Name() != "web" || deploys[1].Name() != "migrate" {
+				t.Fatalf("expected the Deployment and the Job to be workloads, got %v", deploys)
+			}
+
+			err = matchApplied(deploys, workloadIndex, test.edit(applied(t, objects)), len(objects))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("expected %q, got: %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, deploy := range deploys {
+				if deploy.Workload.GetUID() != types.UID(deploy.Name()+"-uid") {
+					t.Errorf("expected %s %s to be replaced by the applied object, got UID %q",
+						deploy.Kind(), deploy.Name(), deploy.Workload.GetUID())
+				}
+			}
+		})
+	}
+}
+
+func TestWithJobHint(t *testing.T) {
+	objects, err := decodeAll([]byte(mixedManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, _ := findWorkloads(objects, "test", nil)
+	applyErr := fmt.Errorf("exit status 1")
+
+	err = withJobHint(applyErr, deploys)
+	if err == nil || !strings.Contains(err.Error(), "delete job/migrate") {
+		t.Errorf("expected a hint to delete the Job, got: %v", err)
+	}
+	if err := withJobHint(applyErr, deploys[:1]); err != applyErr {
+		t.Errorf("expected no hint without a Job, got: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/simulation"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Load reads a recording.
+func Load(r io.Reader) ([]Entry, error) {
+	result := []Entry{}
+	scanner := bufio.NewScanner(r)
+
+	// Pods and ReplicaSets can be much bigger than the default 64k line limit.
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		result = append(result, entry)
+	}
+	return result, scanner.Err()
+}
+
+// Deploys finds the recorded workloads, so that trackers can track them
+// again.
+func Deploys(entries []Entry) ([]*tracker.Deploy, error) {
+	result := []*tracker.Deploy{}
+	for _, e := range entries {
+		if e.Source != SourceDeploy {
+			continue
+		}
+		workload := &unstructured.Unstructured{}
+		err := json.Unmarshal(e.Object, &workload.Object)
+		if err != nil {
+			return nil, err
+		}
+
+		// Older recordings only had Deployments, and didn't always say so.
+		if workload.GetKind() == "" && e.Resource == deploymentGVR.Resource {
+			workload.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+		}
+		result = append(result, &tracker.Deploy{
+			ID:               e.DeployID,
+			Workload:         workload,
+			PodTemplatePaths: e.PodTemplatePaths,
+		})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("Recording has no deploy. Was it recorded with --record?")
+	}
+	return result, nil
+}
+
+// Play injects the recorded events into a simulated cluster, so that trackers
+// using cluster.Clients() see what the recorded trackers saw.
+//
+// speed scales the time between events: 1 plays at the recorded speed, and
+// 10 plays ten times faster.
+//
+// When trackers share clients, they record the same event more than once,
+// so Play skips any event that's older than one it already injected.
+func Play(ctx context.Context, cluster *simulation.Cluster, entries []Entry, speed float64) error {
+	if speed <= 0 {
+		return fmt.Errorf("speed must be positive, got %v", speed)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// The newest resource version we've injected for each object.
+	// Metadata is injected along with full objects, so it's tracked separately.
+	type injected struct {
+		uid     types.UID
+		partial bool
+	}
+	latest := make(map[injected]int64)
+
+	start := time.Now()
+	recordStart := entries[0].Time
+	for _, e := range entries {
+		delay := time.Duration(float64(e.Time.Sub(recordStart))/speed) - time.Since(start)
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		gvr, err := e.GroupVersionResource()
+		if err != nil {
+			return err
+		}
+		obj, err := decode(cluster.Mapper, e)
+		if err != nil {
+			return err
+		}
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+
+		// Resource versions are opaque, but in practice they're integers.
+		// If they're not, inject every event.
+		key := injected{uid: objMeta.GetUID(), partial: e.Source == SourceMetadata}
+		rv, err := strconv.ParseInt(objMeta.GetResourceVersion(), 10, 64)
+		if err == nil {
+			if rv <= latest[key] {
+				continue
+			}
+			latest[key] = rv
+			if !key.partial {
+				latest[injected{uid: key.uid, partial: true}] = rv
+			}
+		}
+
+		// Pods report their ages as of when they were recorded.
+		cluster.AdvanceTo(e.Time)
+		err = cluster.Inject(gvr, e.Type, obj)
+		if err != nil {
+			return fmt.Errorf("injecting %s %s: %v", e.Resource, objMeta.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// Decodes an entry into the type that the simulated cluster's fakes expect.
+func decode(mapper meta.RESTMapper, e Entry) (runtime.Object, error) {
+	gvr, err := e.GroupVersionResource()
+	if err != nil {
+		return nil, err
+	}
+	gvk, err := mapper.KindFor(gvr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't replay %s: %v", e.Resource, err)
+	}
+
+	var obj runtime.Object
+	if e.Source == SourceMetadata {
+		obj = &metav1.PartialObjectMetadata{}
+	} else {
+		obj, err = scheme.Scheme.New(gvk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(e.Object, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// Typed clients drop the TypeMeta, but the fakes need it.
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	return obj, nil
+}
@@ -0,0 +1,353 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/3-kubespy/kubespy"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/metadata"
+)
+
+// Where an Entry came from.
+const (
+	// The applied Deployment, before any tracker started.
+	SourceDeploy = "deploy"
+
+	// The typed client, e.g., runPodInformer.
+	SourceKube = "kube"
+
+	// The dynamic client, e.g., kubectl rollout status.
+	SourceDynamic = "dynamic"
+
+	// The metadata client, e.g., the OwnerFetcher.
+	SourceMetadata = "metadata"
+
+	// The kubespy watch.Forever channels.
+	SourceKubespy = "kubespy"
+)
+
+var (
+	podGVR        = v1.SchemeGroupVersion.WithResource("pods")
+	replicaSetGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+// An Entry is one line of a recording: a watch event, or an item of a list,
+// which we record as an ADDED event.
+type Entry struct {
+	Time       time.Time       `json:"time"`
+	Source     string          `json:"source"`
+	APIVersion string          `json:"apiVersion"`
+	Resource   string          `json:"resource"`
+	Type       watch.EventType `json:"type"`
+
+	// Only set on the deploy entry.
+	DeployID         string                `json:"deployID,omitempty"`
+	PodTemplatePaths tilt.PodTemplatePaths `json:"podTemplatePaths,omitempty"`
+
+	Object json.RawMessage `json:"object"`
+}
+
+func (e Entry) GroupVersionResource() (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(e.APIVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return gv.WithResource(e.Resource), nil
+}
+
+// A Recorder writes every watch event the trackers see to a JSONL file.
+//
+// The Recorder is safe to share between trackers, e.g., when comparing them.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// RecordDeploy records the applied workload, so that the replayer knows
+// what to track.
+func (r *Recorder) RecordDeploy(deploy *tracker.Deploy) {
+	gvr, _ := meta.UnsafeGuessKindToResource(deploy.Workload.GroupVersionKind())
+	r.write(Entry{
+		Source:           SourceDeploy,
+		APIVersion:       gvr.GroupVersion().String(),
+		Resource:         gvr.Resource,
+		Type:             watch.Added,
+		DeployID:         deploy.ID,
+		PodTemplatePaths: deploy.PodTemplatePaths,
+	}, deploy.Workload)
+}
+
+func (r *Recorder) record(source string, gvr schema.GroupVersionResource, e watch.Event) {
+	// Errors and bookmarks don't change what's in the cluster.
+	if e.Type != watch.Added && e.Type != watch.Modified && e.Type != watch.Deleted {
+		return
+	}
+	r.write(Entry{
+		Source:     source,
+		APIVersion: gvr.GroupVersion().String(),
+		Resource:   gvr.Resource,
+		Type:       e.Type,
+	}, e.Object)
+}
+
+// Writes the entry with its time and object filled in.
+func (r *Recorder) write(entry Entry, obj runtime.Object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	content, err := json.Marshal(obj)
+	if err != nil {
+		r.err = err
+		return
+	}
+
+	entry.Time = time.Now()
+	entry.Object = content
+	r.err = r.enc.Encode(entry)
+}
+
+// Tees a watch into the recording.
+func (r *Recorder) tee(source string, gvr schema.GroupVersionResource, w watch.Interface) watch.Interface {
+	return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+		r.record(source, gvr, e)
+		return e, true
+	})
+}
+
+// Clients wraps clients so that every list and watch the trackers make is
+// recorded.
+//
+// Helm's Kube client opens its own connections, so it isn't recorded.
+func (r *Recorder) Clients(clients tracker.Clients) tracker.Clients {
+	result := clients
+	result.Kube = recordingKube{Interface: clients.Kube, r: r}
+	result.Dynamic = recordingDynamic{Interface: clients.Dynamic, r: r}
+	result.Metadata = recordingMetadata{Interface: clients.Metadata, r: r}
+	result.KubespyWatch = func(namespace, name string) (kubespy.DeploymentEvents, error) {
+		events, err := clients.KubespyWatch(namespace, name)
+		if err != nil {
+			return events, err
+		}
+		return r.teeKubespy(events), nil
+	}
+	return result
+}
+
+func (r *Recorder) teeKubespy(events kubespy.DeploymentEvents) kubespy.DeploymentEvents {
+	done := make(chan struct{})
+	tee := func(gvr schema.GroupVersionResource, in <-chan watch.Event) <-chan watch.Event {
+		out := make(chan watch.Event)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case e, ok := <-in:
+					if !ok {
+						return
+					}
+					r.record(SourceKubespy, gvr, e)
+					select {
+					case out <- e:
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+		return out
+	}
+
+	stopOnce := sync.Once{}
+	return kubespy.DeploymentEvents{
+		Deployment:  tee(deploymentGVR, events.Deployment),
+		ReplicaSets: tee(replicaSetGVR, events.ReplicaSets),
+		Pods:        tee(podGVR, events.Pods),
+		Stop: func() {
+			stopOnce.Do(func() {
+				close(done)
+				if events.Stop != nil {
+					events.Stop()
+				}
+			})
+		},
+	}
+}
+
+// The informers only use the typed client to list and watch pods.
+type recordingKube struct {
+	kubernetes.Interface
+	r *Recorder
+}
+
+func (c recordingKube) CoreV1() corev1client.CoreV1Interface {
+	return recordingCoreV1{CoreV1Interface: c.Interface.CoreV1(), r: c.r}
+}
+
+type recordingCoreV1 struct {
+	corev1client.CoreV1Interface
+	r *Recorder
+}
+
+func (c recordingCoreV1) Pods(namespace string) corev1client.PodInterface {
+	return recordingPods{PodInterface: c.CoreV1Interface.Pods(namespace), r: c.r}
+}
+
+type recordingPods struct {
+	corev1client.PodInterface
+	r *Recorder
+}
+
+func (c recordingPods) List(ctx context.Context, opts metav1.ListOptions) (*v1.PodList, error) {
+	list, err := c.PodInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		c.r.record(SourceKube, podGVR, watch.Event{Type: watch.Added, Object: &list.Items[i]})
+	}
+	return list, nil
+}
+
+func (c recordingPods) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.PodInterface.Watch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.tee(SourceKube, podGVR, w), nil
+}
+
+type recordingDynamic struct {
+	dynamic.Interface
+	r *Recorder
+}
+
+func (c recordingDynamic) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return recordingDynamicResource{NamespaceableResourceInterface: c.Interface.Resource(gvr), gvr: gvr, r: c.r}
+}
+
+type recordingDynamicResource struct {
+	dynamic.NamespaceableResourceInterface
+	gvr schema.GroupVersionResource
+	r   *Recorder
+}
+
+func (c recordingDynamicResource) Namespace(ns string) dynamic.ResourceInterface {
+	return recordingDynamicNamespace{ResourceInterface: c.NamespaceableResourceInterface.Namespace(ns), gvr: c.gvr, r: c.r}
+}
+
+func (c recordingDynamicResource) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	return recordingDynamicNamespace{ResourceInterface: c.NamespaceableResourceInterface, gvr: c.gvr, r: c.r}.List(ctx, opts)
+}
+
+func (c recordingDynamicResource) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return recordingDynamicNamespace{ResourceInterface: c.NamespaceableResourceInterface, gvr: c.gvr, r: c.r}.Watch(ctx, opts)
+}
+
+type recordingDynamicNamespace struct {
+	dynamic.ResourceInterface
+	gvr schema.GroupVersionResource
+	r   *Recorder
+}
+
+func (c recordingDynamicNamespace) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	list, err := c.ResourceInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		c.r.record(SourceDynamic, c.gvr, watch.Event{Type: watch.Added, Object: &list.Items[i]})
+	}
+	return list, nil
+}
+
+func (c recordingDynamicNamespace) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.ResourceInterface.Watch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.tee(SourceDynamic, c.gvr, w), nil
+}
+
+type recordingMetadata struct {
+	metadata.Interface
+	r *Recorder
+}
+
+func (c recordingMetadata) Resource(gvr schema.GroupVersionResource) metadata.Getter {
+	return recordingMetadataResource{Getter: c.Interface.Resource(gvr), gvr: gvr, r: c.r}
+}
+
+type recordingMetadataResource struct {
+	metadata.Getter
+	gvr schema.GroupVersionResource
+	r   *Recorder
+}
+
+func (c recordingMetadataResource) Namespace(ns string) metadata.ResourceInterface {
+	return recordingMetadataNamespace{ResourceInterface: c.Getter.Namespace(ns), gvr: c.gvr, r: c.r}
+}
+
+func (c recordingMetadataResource) List(ctx context.Context, opts metav1.ListOptions) (*metav1.PartialObjectMetadataList, error) {
+	return recordingMetadataNamespace{ResourceInterface: c.Getter, gvr: c.gvr, r: c.r}.List(ctx, opts)
+}
+
+func (c recordingMetadataResource) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return recordingMetadataNamespace{ResourceInterface: c.Getter, gvr: c.gvr, r: c.r}.Watch(ctx, opts)
+}
+
+type recordingMetadataNamespace struct {
+	metadata.ResourceInterface
+	gvr schema.GroupVersionResource
+	r   *Recorder
+}
+
+func (c recordingMetadataNamespace) List(ctx context.Context, opts metav1.ListOptions) (*metav1.PartialObjectMetadataList, error) {
+	list, err := c.ResourceInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		c.r.record(SourceMetadata, c.gvr, watch.Event{Type: watch.Added, Object: &list.Items[i]})
+	}
+	return list, nil
+}
+
+func (c recordingMetadataNamespace) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.ResourceInterface.Watch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.tee(SourceMetadata, c.gvr, w), nil
+}
@@ -0,0 +1,45 @@
+package replay
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDeploysKeepPodTemplatePaths(t *testing.T) {
+	paths := tilt.PodTemplatePaths{}
+	err := paths.Set("MyApp.example.com={.spec.podTemplate}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workload := &unstructured.Unstructured{}
+	workload.SetAPIVersion("example.com/v1")
+	workload.SetKind("MyApp")
+	workload.SetName("web")
+
+	buf := &bytes.Buffer{}
+	r := NewRecorder(buf)
+	r.RecordDeploy(&tracker.Deploy{ID: "test", Workload: workload, PodTemplatePaths: paths})
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+
+	entries, err := Load(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deploys(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deploys) != 1 {
+		t.Fatalf("expected 1 deploy, got %d", len(deploys))
+	}
+	if !reflect.DeepEqual(deploys[0].PodTemplatePaths, paths) {
+		t.Errorf("expected paths %v, got %v", paths, deploys[0].PodTemplatePaths)
+	}
+}
@@ -0,0 +1,398 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/3-kubespy/kubespy"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+var (
+	PodGVR        = v1.SchemeGroupVersion.WithResource("pods")
+	ReplicaSetGVR = appsv1.SchemeGroupVersion.WithResource("replicasets")
+	DeploymentGVR = appsv1.SchemeGroupVersion.WithResource("deployments")
+
+	podGVK        = v1.SchemeGroupVersion.WithKind("Pod")
+	replicaSetGVK = appsv1.SchemeGroupVersion.WithKind("ReplicaSet")
+	deploymentGVK = appsv1.SchemeGroupVersion.WithKind("Deployment")
+)
+
+// The time the simulated clock starts at.
+var Epoch = time.Date(2020, time.November, 17, 0, 0, 0, 0, time.UTC)
+
+// A Scenario describes how the simulated cluster's pods behave.
+type Scenario struct {
+	// The number of steps a new pod spends in ContainerCreating before its
+	// container starts.
+	StartupSteps int
+
+	// When set, containers exit with an error instead of running, and
+	// go into CrashLoopBackOff.
+	Crash bool
+
+	// The number of steps a rollout may go without becoming available before
+	// the Deployment reports ProgressDeadlineExceeded. Zero means never.
+	ProgressDeadlineSteps int
+}
+
+var (
+	Healthy   = Scenario{StartupSteps: 1, ProgressDeadlineSteps: 10}
+	SlowStart = Scenario{StartupSteps: 5, ProgressDeadlineSteps: 10}
+	Crash     = Scenario{StartupSteps: 1, Crash: true, ProgressDeadlineSteps: 10}
+)
+
+// A Cluster is an in-memory Kubernetes cluster, backed by client-go fakes,
+// with a simplified Deployment controller, ReplicaSet controller, and kubelet.
+//
+// The cluster only changes when you call Apply or Step, so tests can
+// control exactly what the trackers see and when.
+//
+// The fakes don't share storage, so every write goes to all of them. Don't
+// write to the fakes directly.
+type Cluster struct {
+	Kube     *kubefake.Clientset
+	Dynamic  *dynamicfake.FakeDynamicClient
+	Metadata *metadatafake.FakeMetadataClient
+	Mapper   meta.RESTMapper
+
+	scenario Scenario
+
+	mu          sync.Mutex
+	now         time.Time
+	step        int
+	uidCount    int
+	nameCount   int
+	deployments map[types.NamespacedName]*appsv1.Deployment
+	rses        map[types.NamespacedName]*appsv1.ReplicaSet
+	pods        map[types.NamespacedName]*v1.Pod
+
+	// The step each pod was created, for the kubelet.
+	podBirths map[types.UID]int
+
+	// The step each Deployment's current rollout started, for the progress deadline.
+	rolloutStarts map[types.UID]int
+}
+
+func NewCluster(scenario Scenario) *Cluster {
+	metaScheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(metaScheme)
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(podGVK, meta.RESTScopeNamespace)
+	mapper.Add(replicaSetGVK, meta.RESTScopeNamespace)
+	mapper.Add(deploymentGVK, meta.RESTScopeNamespace)
+
+	return &Cluster{
+		Kube:     kubefake.NewSimpleClientset(),
+		Dynamic:  dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		Metadata: metadatafake.NewSimpleMetadataClient(metaScheme),
+		Mapper:   mapper,
+
+		scenario:      scenario,
+		now:           Epoch,
+		deployments:   make(map[types.NamespacedName]*appsv1.Deployment),
+		rses:          make(map[types.NamespacedName]*appsv1.ReplicaSet),
+		pods:          make(map[types.NamespacedName]*v1.Pod),
+		podBirths:     make(map[types.UID]int),
+		rolloutStarts: make(map[types.UID]int),
+	}
+}
+
+// OwnerFetcher creates an OwnerFetcher that reads from the simulated cluster.
+func (c *Cluster) OwnerFetcher(ctx context.Context) *tilt.OwnerFetcher {
+	return tilt.NewOwnerFetcherForClients(ctx, c.Mapper, c.Metadata)
+}
+
+// Clients for running trackers against the simulated cluster.
+//
+// The helm tracker always loads the kubeconfig, so it can't be simulated.
+func (c *Cluster) Clients() tracker.Clients {
+	return tracker.Clients{
+		Kube:     c.Kube,
+		Dynamic:  c.Dynamic,
+		Metadata: c.Metadata,
+		Mapper:   c.Mapper,
+		KubespyWatch: func(namespace, name string) (kubespy.DeploymentEvents, error) {
+			return kubespy.WatchDeploymentForClient(c.Dynamic, namespace, name)
+		},
+		Now: c.Now,
+	}
+}
+
+// Now is the simulated time. Each Step advances it by one second.
+func (c *Cluster) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AdvanceTo moves the simulated clock forward to t, without stepping the
+// controllers, e.g., to replay events at the time they were recorded.
+func (c *Cluster) AdvanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Apply creates or updates a Deployment, like `kubectl apply`, and returns
+// the Deployment as stored by the server.
+//
+// The controllers don't respond until the next Step.
+func (c *Cluster) Apply(deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d := deployment.DeepCopy()
+	d.TypeMeta = metav1.TypeMeta{Kind: deploymentGVK.Kind, APIVersion: deploymentGVK.GroupVersion().String()}
+	if d.Namespace == "" {
+		d.Namespace = "default"
+	}
+	if d.Spec.Replicas == nil {
+		replicas := int32(1)
+		d.Spec.Replicas = &replicas
+	}
+
+	key := types.NamespacedName{Namespace: d.Namespace, Name: d.Name}
+	existing, ok := c.deployments[key]
+	if ok {
+		d.UID = existing.UID
+		d.CreationTimestamp = existing.CreationTimestamp
+		d.Generation = existing.Generation + 1
+		d.Status = existing.Status
+
+		// The server owns the revision annotation.
+		revision, hasRevision := existing.Annotations[revisionAnnotation]
+		if hasRevision {
+			if d.Annotations == nil {
+				d.Annotations = make(map[string]string)
+			}
+			d.Annotations[revisionAnnotation] = revision
+		}
+	} else {
+		d.UID = c.newUID()
+		d.CreationTimestamp = metav1.NewTime(c.now)
+		d.Generation = 1
+	}
+
+	err := c.write(DeploymentGVR, d, !ok)
+	if err != nil {
+		return nil, err
+	}
+	c.deployments[key] = d
+	return d.DeepCopy(), nil
+}
+
+// Delete removes a Deployment, like `kubectl delete`. Its ReplicaSets and pods
+// are garbage-collected on the next Step.
+func (c *Cluster) Delete(namespace, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	d, ok := c.deployments[key]
+	if !ok {
+		return fmt.Errorf("deployment %s/%s not found", namespace, name)
+	}
+	delete(c.deployments, key)
+	return c.remove(DeploymentGVR, d)
+}
+
+// Inject writes an object straight to the fakes, bypassing the controllers,
+// e.g., to replay recorded watch events. Don't mix it with Apply and Step.
+//
+// ADDED and MODIFIED create or update the object. DELETED removes it, if it
+// exists. A *metav1.PartialObjectMetadata only goes to the metadata fake.
+func (c *Cluster) Inject(gvr schema.GroupVersionResource, eventType watch.EventType, obj runtime.Object) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	ns := objMeta.GetNamespace()
+	name := objMeta.GetName()
+
+	_, err = c.Kube.Tracker().Get(gvr, ns, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	objectExists := err == nil
+
+	_, err = c.Metadata.Resource(gvr).Namespace(ns).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	metadataExists := err == nil
+
+	_, isPartial := obj.(*metav1.PartialObjectMetadata)
+	switch eventType {
+	case watch.Added, watch.Modified:
+		if !isPartial {
+			err = c.writeObject(gvr, obj, !objectExists)
+			if err != nil {
+				return err
+			}
+		}
+		return c.writeMetadata(gvr, obj, !metadataExists)
+
+	case watch.Deleted:
+		if objectExists {
+			err = c.removeObject(gvr, objMeta)
+			if err != nil {
+				return err
+			}
+		}
+		if metadataExists {
+			return c.removeMetadata(gvr, objMeta)
+		}
+		return nil
+	}
+	return fmt.Errorf("Can't inject %s event", eventType)
+}
+
+// Run steps the cluster every interval until ctx is done.
+func (c *Cluster) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := c.Step()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Cluster) newUID() types.UID {
+	c.uidCount++
+	return types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", c.uidCount))
+}
+
+func (c *Cluster) newSuffix() string {
+	c.nameCount++
+	return fmt.Sprintf("%05d", c.nameCount)
+}
+
+// Write an object to every fake.
+func (c *Cluster) write(gvr schema.GroupVersionResource, obj runtime.Object, create bool) error {
+	err := c.writeObject(gvr, obj, create)
+	if err != nil {
+		return err
+	}
+	return c.writeMetadata(gvr, obj, create)
+}
+
+// Write a full object to the typed and dynamic fakes.
+func (c *Cluster) writeObject(gvr schema.GroupVersionResource, obj runtime.Object, create bool) error {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	ns := objMeta.GetNamespace()
+
+	tracker := c.Kube.Tracker()
+	if create {
+		err = tracker.Create(gvr, obj.DeepCopyObject(), ns)
+	} else {
+		err = tracker.Update(gvr, obj.DeepCopyObject(), ns)
+	}
+	if err != nil {
+		return err
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	dynamicClient := c.Dynamic.Resource(gvr).Namespace(ns)
+	if create {
+		_, err = dynamicClient.Create(context.Background(), u, metav1.CreateOptions{})
+	} else {
+		_, err = dynamicClient.Update(context.Background(), u, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Write an object's metadata to the metadata fake.
+func (c *Cluster) writeMetadata(gvr schema.GroupVersionResource, obj runtime.Object, create bool) error {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	ns := objMeta.GetNamespace()
+
+	typeMeta, err := meta.TypeAccessor(obj)
+	if err != nil {
+		return err
+	}
+	partial := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{Kind: typeMeta.GetKind(), APIVersion: typeMeta.GetAPIVersion()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              objMeta.GetName(),
+			Namespace:         ns,
+			UID:               objMeta.GetUID(),
+			ResourceVersion:   objMeta.GetResourceVersion(),
+			Generation:        objMeta.GetGeneration(),
+			CreationTimestamp: objMeta.GetCreationTimestamp(),
+			DeletionTimestamp: objMeta.GetDeletionTimestamp(),
+			Labels:            objMeta.GetLabels(),
+			Annotations:       objMeta.GetAnnotations(),
+			OwnerReferences:   objMeta.GetOwnerReferences(),
+		},
+	}
+	metadataClient := c.Metadata.Resource(gvr).Namespace(ns).(metadatafake.MetadataClient)
+	if create {
+		_, err = metadataClient.CreateFake(partial.DeepCopy(), metav1.CreateOptions{})
+	} else {
+		_, err = metadataClient.UpdateFake(partial.DeepCopy(), metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Remove an object from every fake.
+func (c *Cluster) remove(gvr schema.GroupVersionResource, obj metav1.Object) error {
+	err := c.removeObject(gvr, obj)
+	if err != nil {
+		return err
+	}
+	return c.removeMetadata(gvr, obj)
+}
+
+func (c *Cluster) removeObject(gvr schema.GroupVersionResource, obj metav1.Object) error {
+	ns := obj.GetNamespace()
+	name := obj.GetName()
+	err := c.Kube.Tracker().Delete(gvr, ns, name)
+	if err != nil {
+		return err
+	}
+	return c.Dynamic.Resource(gvr).Namespace(ns).Delete(context.Background(), name, metav1.DeleteOptions{})
+}
+
+func (c *Cluster) removeMetadata(gvr schema.GroupVersionResource, obj metav1.Object) error {
+	return c.Metadata.Resource(gvr).Namespace(obj.GetNamespace()).Delete(context.Background(), obj.GetName(), metav1.DeleteOptions{})
+}
@@ -0,0 +1,157 @@
+package simulation
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/tracker"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestTrackers(t *testing.T) {
+	strategies := []string{
+		tracker.StrategyNaive,
+		tracker.StrategyRollout,
+		tracker.StrategyKubespy,
+		tracker.StrategyTilt,
+	}
+	scenarios := []struct {
+		name     string
+		scenario Scenario
+		wantErr  bool
+	}{
+		{"Healthy", Healthy, false},
+		{"SlowStart", SlowStart, false},
+		{"Crash", Crash, true},
+	}
+
+	for _, sc := range scenarios {
+		for _, strategy := range strategies {
+			sc, strategy := sc, strategy
+			t.Run(sc.name+"/"+strategy, func(t *testing.T) {
+				t.Parallel()
+
+				err := track(t, sc.scenario, strategy)
+				if sc.wantErr {
+					if err == nil {
+						t.Fatalf("expected %s to fail", strategy)
+					}
+					if err == context.DeadlineExceeded {
+						t.Fatalf("expected %s to fail, but it timed out", strategy)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("expected %s to succeed, got: %v", strategy, err)
+				}
+			})
+		}
+	}
+}
+
+func TestPodAgesUseSimulatedClock(t *testing.T) {
+	events := make(chan tracker.Event, 100)
+	err := trackWithProgress(t, Healthy, tracker.StrategyNaive, func(e tracker.Event) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	sawAge := false
+	for e := range events {
+		i := strings.Index(e.Message, "Age: ")
+		if i == -1 {
+			continue
+		}
+		sawAge = true
+		age, err := time.ParseDuration(e.Message[i+len("Age: "):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if age < 0 || age > time.Minute {
+			t.Errorf("expected a simulated pod age, got %s", age)
+		}
+	}
+	if !sawAge {
+		t.Fatal("expected a pod status with an age")
+	}
+}
+
+func track(t *testing.T, scenario Scenario, strategy string) error {
+	return trackWithProgress(t, scenario, strategy, func(tracker.Event) {})
+}
+
+// Applies a Deployment to a simulated cluster, and tracks it with the
+// strategy until it decides.
+func trackWithProgress(t *testing.T, scenario Scenario, strategy string, progress tracker.Progress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := NewCluster(scenario)
+	tr, err := tracker.New(ctx, strategy, c.Clients())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close(tr)
+	if k, ok := tr.(tracker.Kubespy); ok {
+		k.Out = ioutil.Discard
+		tr = k
+	}
+
+	deploy := &tracker.Deploy{ID: "test", Workload: testDeployment(t)}
+	err = tr.Prepare(deploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed, err := deploy.Deployment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := c.Apply(typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deploy.SetDeployment(applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = c.Run(ctx, 10*time.Millisecond)
+	}()
+	return tr.Track(ctx, deploy, progress)
+}
+
+func testDeployment(t *testing.T) *unstructured.Unstructured {
+	labels := map[string]string{"app": "my-busybox"}
+	d := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "my-busybox", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "my-busybox", Image: "my-busybox"}},
+				},
+			},
+		},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
@@ -0,0 +1,596 @@
+package simulation
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	revisionAnnotation        = "deployment.kubernetes.io/revision"
+	revisionHistoryAnnotation = "deployment.kubernetes.io/revision-history"
+	lastAppliedAnnotation     = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// Step advances the simulated cluster by one tick: the Deployment controller
+// rolls out new ReplicaSets, the ReplicaSet controller creates and deletes
+// pods, the kubelet advances each pod's phase, and the garbage collector
+// cleans up orphans.
+func (c *Cluster) Step() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.step++
+	c.now = c.now.Add(time.Second)
+
+	steps := []func() error{
+		c.collectGarbage,
+		c.syncDeployments,
+		c.syncReplicaSets,
+		c.syncPods,
+		c.updateReplicaSetStatuses,
+		c.updateDeploymentStatuses,
+	}
+	for _, step := range steps {
+		err := step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) collectGarbage() error {
+	for _, key := range sortedKeys(c.rses) {
+		rs := c.rses[key]
+		owner := metav1.GetControllerOf(rs)
+		if owner == nil || c.deploymentByUID(owner.UID) != nil {
+			continue
+		}
+		delete(c.rses, key)
+		err := c.remove(ReplicaSetGVR, rs)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range sortedKeys(c.pods) {
+		pod := c.pods[key]
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || c.replicaSetByUID(owner.UID) != nil {
+			continue
+		}
+		err := c.removePod(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) syncDeployments() error {
+	for _, key := range sortedKeys(c.deployments) {
+		err := c.syncDeployment(c.deployments[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) syncDeployment(d *appsv1.Deployment) error {
+	hash := templateHash(d.Spec.Template)
+	rses := c.replicaSetsOf(d)
+	maxRevision := int64(0)
+	var newRS *appsv1.ReplicaSet
+	for _, rs := range rses {
+		if revisionOf(rs) > maxRevision {
+			maxRevision = revisionOf(rs)
+		}
+		if rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey] == hash {
+			newRS = rs
+		}
+	}
+
+	if newRS == nil {
+		rs, err := c.createReplicaSet(d, hash, maxRevision+1)
+		if err != nil {
+			return err
+		}
+		newRS = rs
+		c.rolloutStarts[d.UID] = c.step
+	} else if revisionOf(newRS) < maxRevision {
+		// Rolling back to an old template re-uses its ReplicaSet with a new revision.
+		updated := newRS.DeepCopy()
+		history := updated.Annotations[revisionHistoryAnnotation]
+		if history != "" {
+			history += ","
+		}
+		updated.Annotations[revisionHistoryAnnotation] = history + updated.Annotations[revisionAnnotation]
+		updated.Annotations[revisionAnnotation] = fmt.Sprintf("%d", maxRevision+1)
+		err := c.updateReplicaSet(newRS, updated)
+		if err != nil {
+			return err
+		}
+		newRS = updated
+		c.rolloutStarts[d.UID] = c.step
+	}
+
+	// The new ReplicaSet gets the Deployment's annotations and replica count.
+	updated := newRS.DeepCopy()
+	for k, v := range d.Annotations {
+		if k != revisionAnnotation && k != lastAppliedAnnotation {
+			updated.Annotations[k] = v
+		}
+	}
+	updated.Spec.Replicas = d.Spec.Replicas
+	err := c.updateReplicaSet(newRS, updated)
+	if err != nil {
+		return err
+	}
+	newRS = updated
+
+	// Once the new ReplicaSet is available, scale down the old ones.
+	if newRS.Status.AvailableReplicas >= *d.Spec.Replicas {
+		for _, rs := range rses {
+			if rs.UID == newRS.UID || *rs.Spec.Replicas == 0 {
+				continue
+			}
+			scaled := rs.DeepCopy()
+			zero := int32(0)
+			scaled.Spec.Replicas = &zero
+			err := c.updateReplicaSet(rs, scaled)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.Annotations[revisionAnnotation] != newRS.Annotations[revisionAnnotation] {
+		updated := d.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = make(map[string]string)
+		}
+		updated.Annotations[revisionAnnotation] = newRS.Annotations[revisionAnnotation]
+		return c.updateDeployment(d, updated)
+	}
+	return nil
+}
+
+func (c *Cluster) createReplicaSet(d *appsv1.Deployment, hash string, revision int64) (*appsv1.ReplicaSet, error) {
+	template := d.Spec.Template.DeepCopy()
+	template.Labels = copyMap(template.Labels)
+	template.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+
+	annotations := make(map[string]string)
+	for k, v := range d.Annotations {
+		if k != lastAppliedAnnotation {
+			annotations[k] = v
+		}
+	}
+	annotations[revisionAnnotation] = fmt.Sprintf("%d", revision)
+
+	selector := d.Spec.Selector.DeepCopy()
+	if selector == nil {
+		selector = &metav1.LabelSelector{}
+	}
+	selector.MatchLabels = copyMap(selector.MatchLabels)
+	selector.MatchLabels[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+
+	rs := &appsv1.ReplicaSet{
+		TypeMeta: metav1.TypeMeta{Kind: replicaSetGVK.Kind, APIVersion: replicaSetGVK.GroupVersion().String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("%s-%s", d.Name, hash),
+			Namespace:         d.Namespace,
+			UID:               c.newUID(),
+			Generation:        1,
+			CreationTimestamp: metav1.NewTime(c.now),
+			Labels:            template.Labels,
+			Annotations:       annotations,
+			OwnerReferences:   []metav1.OwnerReference{*metav1.NewControllerRef(d, deploymentGVK)},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: d.Spec.Replicas,
+			Selector: selector,
+			Template: *template,
+		},
+	}
+	err := c.write(ReplicaSetGVR, rs, true)
+	if err != nil {
+		return nil, err
+	}
+	c.rses[types.NamespacedName{Namespace: rs.Namespace, Name: rs.Name}] = rs
+	return rs, nil
+}
+
+func (c *Cluster) syncReplicaSets() error {
+	for _, key := range sortedKeys(c.rses) {
+		rs := c.rses[key]
+		active := c.activePodsOf(rs)
+		for i := len(active); i < int(*rs.Spec.Replicas); i++ {
+			err := c.createPod(rs)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Delete the newest pods first.
+		for i := len(active) - 1; i >= int(*rs.Spec.Replicas); i-- {
+			terminating := active[i].DeepCopy()
+			now := metav1.NewTime(c.now)
+			terminating.DeletionTimestamp = &now
+			err := c.updatePod(active[i], terminating)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) createPod(rs *appsv1.ReplicaSet) error {
+	template := rs.Spec.Template.DeepCopy()
+	pod := &v1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: podGVK.Kind, APIVersion: podGVK.GroupVersion().String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("%s-%s", rs.Name, c.newSuffix()),
+			Namespace:         rs.Namespace,
+			UID:               c.newUID(),
+			CreationTimestamp: metav1.NewTime(c.now),
+			Labels:            template.Labels,
+			Annotations:       template.Annotations,
+			OwnerReferences:   []metav1.OwnerReference{*metav1.NewControllerRef(rs, replicaSetGVK)},
+		},
+		Spec: template.Spec,
+		Status: v1.PodStatus{
+			Phase: v1.PodPending,
+		},
+	}
+	err := c.write(PodGVR, pod, true)
+	if err != nil {
+		return err
+	}
+	c.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	c.podBirths[pod.UID] = c.step
+	return nil
+}
+
+// The kubelet: start containers, crash them, and finish deleting pods.
+func (c *Cluster) syncPods() error {
+	for _, key := range sortedKeys(c.pods) {
+		pod := c.pods[key]
+		if pod.DeletionTimestamp != nil {
+			if pod.DeletionTimestamp.Time.Before(c.now) {
+				err := c.removePod(key)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		age := c.step - c.podBirths[pod.UID]
+		if age == 0 {
+			continue
+		}
+
+		updated := pod.DeepCopy()
+		updated.Status = c.podStatus(pod, age)
+		err := c.updatePod(pod, updated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) podStatus(pod *v1.Pod, age int) v1.PodStatus {
+	status := pod.Status.DeepCopy()
+	if status.StartTime == nil {
+		startTime := metav1.NewTime(c.now)
+		status.StartTime = &startTime
+	}
+
+	ready := false
+	if age <= c.scenario.StartupSteps {
+		status.Phase = v1.PodPending
+		status.ContainerStatuses = containerStatuses(pod, status.ContainerStatuses, v1.ContainerState{
+			Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}, false)
+	} else if c.scenario.Crash {
+		// Alternate between exiting and backing off, like a real crash loop.
+		status.Phase = v1.PodRunning
+		state := v1.ContainerState{
+			Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+		}
+		restarted := false
+		if (age-c.scenario.StartupSteps)%2 == 1 {
+			state = v1.ContainerState{
+				Terminated: &v1.ContainerStateTerminated{ExitCode: 1, Reason: "Error", FinishedAt: metav1.NewTime(c.now)},
+			}
+			restarted = true
+		}
+		status.ContainerStatuses = containerStatuses(pod, status.ContainerStatuses, state, restarted)
+	} else {
+		status.Phase = v1.PodRunning
+		startedAt := metav1.NewTime(c.now)
+		if len(status.ContainerStatuses) > 0 && status.ContainerStatuses[0].State.Running != nil {
+			startedAt = status.ContainerStatuses[0].State.Running.StartedAt
+		}
+		status.ContainerStatuses = containerStatuses(pod, status.ContainerStatuses, v1.ContainerState{
+			Running: &v1.ContainerStateRunning{StartedAt: startedAt},
+		}, false)
+		ready = true
+	}
+
+	conditionStatus := v1.ConditionFalse
+	if ready {
+		conditionStatus = v1.ConditionTrue
+	}
+	status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: conditionStatus}}
+	return *status
+}
+
+func containerStatuses(pod *v1.Pod, old []v1.ContainerStatus, state v1.ContainerState, restarted bool) []v1.ContainerStatus {
+	result := []v1.ContainerStatus{}
+	for i, container := range pod.Spec.Containers {
+		restarts := int32(0)
+		if i < len(old) {
+			restarts = old[i].RestartCount
+		}
+		if restarted {
+			restarts++
+		}
+		result = append(result, v1.ContainerStatus{
+			Name:         container.Name,
+			Image:        container.Image,
+			State:        state,
+			Ready:        state.Running != nil,
+			RestartCount: restarts,
+		})
+	}
+	return result
+}
+
+func (c *Cluster) updateReplicaSetStatuses() error {
+	for _, key := range sortedKeys(c.rses) {
+		rs := c.rses[key]
+		updated := rs.DeepCopy()
+		updated.Status = appsv1.ReplicaSetStatus{ObservedGeneration: rs.Generation}
+		for _, pod := range c.activePodsOf(rs) {
+			updated.Status.Replicas++
+			if isPodReady(pod) {
+				updated.Status.ReadyReplicas++
+				updated.Status.AvailableReplicas++
+			}
+		}
+		err := c.updateReplicaSet(rs, updated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) updateDeploymentStatuses() error {
+	for _, key := range sortedKeys(c.deployments) {
+		d := c.deployments[key]
+		hash := templateHash(d.Spec.Template)
+		desired := *d.Spec.Replicas
+
+		status := appsv1.DeploymentStatus{ObservedGeneration: d.Generation}
+		var newRS *appsv1.ReplicaSet
+		for _, rs := range c.replicaSetsOf(d) {
+			status.Replicas += rs.Status.Replicas
+			status.ReadyReplicas += rs.Status.ReadyReplicas
+			status.AvailableReplicas += rs.Status.AvailableReplicas
+			if rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey] == hash {
+				newRS = rs
+				status.UpdatedReplicas = rs.Status.Replicas
+			}
+		}
+		if status.AvailableReplicas < desired {
+			status.UnavailableReplicas = desired - status.AvailableReplicas
+		}
+
+		available := condition(appsv1.DeploymentAvailable, v1.ConditionFalse,
+			"MinimumReplicasUnavailable", "Deployment does not have minimum availability.")
+		if status.AvailableReplicas >= desired {
+			available = condition(appsv1.DeploymentAvailable, v1.ConditionTrue,
+				"MinimumReplicasAvailable", "Deployment has minimum availability.")
+		}
+
+		var progressing appsv1.DeploymentCondition
+		if newRS == nil {
+			progressing = condition(appsv1.DeploymentProgressing, v1.ConditionTrue,
+				"NewReplicaSetCreated", "Waiting for the new ReplicaSet.")
+		} else if newRS.Status.AvailableReplicas >= desired && status.Replicas == status.UpdatedReplicas {
+			progressing = condition(appsv1.DeploymentProgressing, v1.ConditionTrue,
+				"NewReplicaSetAvailable", fmt.Sprintf("ReplicaSet %q has successfully progressed.", newRS.Name))
+		} else if c.scenario.ProgressDeadlineSteps > 0 &&
+			c.step-c.rolloutStarts[d.UID] > c.scenario.ProgressDeadlineSteps {
+			progressing = condition(appsv1.DeploymentProgressing, v1.ConditionFalse,
+				"ProgressDeadlineExceeded", fmt.Sprintf("ReplicaSet %q has timed out progressing.", newRS.Name))
+		} else {
+			progressing = condition(appsv1.DeploymentProgressing, v1.ConditionTrue,
+				"ReplicaSetUpdated", fmt.Sprintf("ReplicaSet %q is progressing.", newRS.Name))
+		}
+		status.Conditions = []appsv1.DeploymentCondition{
+			c.transition(d.Status.Conditions, available),
+			c.transition(d.Status.Conditions, progressing),
+		}
+
+		updated := d.DeepCopy()
+		updated.Status = status
+		err := c.updateDeployment(d, updated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func condition(t appsv1.DeploymentConditionType, status v1.ConditionStatus, reason, message string) appsv1.DeploymentCondition {
+	return appsv1.DeploymentCondition{Type: t, Status: status, Reason: reason, Message: message}
+}
+
+// Timestamp a condition, keeping the old timestamps if nothing changed,
+// so that we don't write a new status every step.
+func (c *Cluster) transition(old []appsv1.DeploymentCondition, cond appsv1.DeploymentCondition) appsv1.DeploymentCondition {
+	now := metav1.NewTime(c.now)
+	cond.LastUpdateTime = now
+	cond.LastTransitionTime = now
+	for _, o := range old {
+		if o.Type != cond.Type {
+			continue
+		}
+		if o.Status == cond.Status {
+			cond.LastTransitionTime = o.LastTransitionTime
+			if o.Reason == cond.Reason && o.Message == cond.Message {
+				cond.LastUpdateTime = o.LastUpdateTime
+			}
+		}
+	}
+	return cond
+}
+
+func (c *Cluster) updateDeployment(old, updated *appsv1.Deployment) error {
+	if reflect.DeepEqual(old, updated) {
+		return nil
+	}
+	err := c.write(DeploymentGVR, updated, false)
+	if err != nil {
+		return err
+	}
+	c.deployments[types.NamespacedName{Namespace: updated.Namespace, Name: updated.Name}] = updated
+	return nil
+}
+
+func (c *Cluster) updateReplicaSet(old, updated *appsv1.ReplicaSet) error {
+	if reflect.DeepEqual(old, updated) {
+		return nil
+	}
+	err := c.write(ReplicaSetGVR, updated, false)
+	if err != nil {
+		return err
+	}
+	c.rses[types.NamespacedName{Namespace: updated.Namespace, Name: updated.Name}] = updated
+	return nil
+}
+
+func (c *Cluster) updatePod(old, updated *v1.Pod) error {
+	if reflect.DeepEqual(old, updated) {
+		return nil
+	}
+	err := c.write(PodGVR, updated, false)
+	if err != nil {
+		return err
+	}
+	c.pods[types.NamespacedName{Namespace: updated.Namespace, Name: updated.Name}] = updated
+	return nil
+}
+
+func (c *Cluster) removePod(key types.NamespacedName) error {
+	pod := c.pods[key]
+	delete(c.pods, key)
+	delete(c.podBirths, pod.UID)
+	return c.remove(PodGVR, pod)
+}
+
+func (c *Cluster) deploymentByUID(uid types.UID) *appsv1.Deployment {
+	for _, d := range c.deployments {
+		if d.UID == uid {
+			return d
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) replicaSetByUID(uid types.UID) *appsv1.ReplicaSet {
+	for _, rs := range c.rses {
+		if rs.UID == uid {
+			return rs
+		}
+	}
+	return nil
+}
+
+// The ReplicaSets controlled by a Deployment, in name order.
+func (c *Cluster) replicaSetsOf(d *appsv1.Deployment) []*appsv1.ReplicaSet {
+	result := []*appsv1.ReplicaSet{}
+	for _, key := range sortedKeys(c.rses) {
+		rs := c.rses[key]
+		owner := metav1.GetControllerOf(rs)
+		if owner != nil && owner.UID == d.UID {
+			result = append(result, rs)
+		}
+	}
+	return result
+}
+
+// The pods controlled by a ReplicaSet that aren't terminating, oldest first.
+func (c *Cluster) activePodsOf(rs *appsv1.ReplicaSet) []*v1.Pod {
+	result := []*v1.Pod{}
+	for _, key := range sortedKeys(c.pods) {
+		pod := c.pods[key]
+		owner := metav1.GetControllerOf(pod)
+		if owner != nil && owner.UID == rs.UID && pod.DeletionTimestamp == nil {
+			result = append(result, pod)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return c.podBirths[result[i].UID] < c.podBirths[result[j].UID]
+	})
+	return result
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func revisionOf(rs *appsv1.ReplicaSet) int64 {
+	revision, _ := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+	return revision
+}
+
+// A stand-in for the Deployment controller's pod-template-hash.
+func templateHash(template v1.PodTemplateSpec) string {
+	data, _ := json.Marshal(template)
+	h := fnv.New32a()
+	_, _ = h.Write(data)
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+func copyMap(m map[string]string) map[string]string {
+	result := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+func sortedKeys(m interface{}) []types.NamespacedName {
+	keys := reflect.ValueOf(m).MapKeys()
+	result := make([]types.NamespacedName, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, k.Interface().(types.NamespacedName))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result
+}
@@ -0,0 +1,91 @@
+package tracker
+
+import (
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/3-kubespy/kubespy"
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/discovery"
+	memory "k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// The clients that Trackers use to talk to the cluster.
+//
+// Swapping these out lets us run the Trackers against a simulated cluster,
+// or record what they see.
+type Clients struct {
+	Kube     kubernetes.Interface
+	Dynamic  dynamic.Interface
+	Metadata metadata.Interface
+	Mapper   meta.RESTMapper
+
+	// kubespy opens its own watches with its own config.
+	KubespyWatch func(namespace, name string) (kubespy.DeploymentEvents, error)
+
+	// The Helm Kube client loads its own config. nil uses the default kubeconfig.
+	HelmGetter genericclioptions.RESTClientGetter
+
+	// If set, the tilt tracker's OwnerFetcher shares these informers instead
+	// of listing and watching on its own.
+	MetadataInformers metadatainformer.SharedInformerFactory
+
+	// Identifies the cluster in owner cache snapshots, e.g., its API server URL.
+	Cluster string
+
+	// If set, the tilt tracker's OwnerFetcher starts from a snapshot in this
+	// directory, and saves one when it closes.
+	OwnerCacheDir string
+
+	// How much the tilt tracker's OwnerFetcher lists and keeps.
+	OwnerCacheOptions tilt.CacheOptions
+
+	// The clock for pod ages, e.g., a simulated cluster's. nil uses time.Now.
+	Now func() time.Time
+}
+
+func NewClients(config *rest.Config) (Clients, error) {
+	kCli, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+
+	dCli, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+
+	mCli, err := metadata.NewForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+
+	return Clients{
+		Kube:         kCli,
+		Dynamic:      dCli,
+		Metadata:     mCli,
+		Mapper:       restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		KubespyWatch: kubespy.WatchDeployment,
+		Cluster:      config.Host,
+	}, nil
+}
+
+// WithMetadataInformers adds a shared metadata informer factory built on
+// the Metadata client. Call it after wrapping the Metadata client, e.g.,
+// for recording, so that the informers use the wrapped client.
+func (c Clients) WithMetadataInformers(resync time.Duration) Clients {
+	c.MetadataInformers = metadatainformer.NewSharedInformerFactory(c.Metadata, resync)
+	return c
+}
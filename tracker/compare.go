@@ -0,0 +1,66 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The outcome of a single Tracker in a race.
+type Result struct {
+	Strategy string
+
+	// How long the Tracker took to decide.
+	Elapsed time.Duration
+
+	// nil if the Tracker declared success.
+	Err error
+
+	// The pods the Tracker reported on, in the order it first saw them.
+	Pods []string
+}
+
+// Compare tracks the same workloads with every Tracker concurrently, and
+// returns their results in the same order as trackers. A Tracker has
+// decided once it's decided on every workload, and fails if it fails any.
+//
+// progress is called from every Tracker's goroutine, one call at a time.
+func Compare(ctx context.Context, deploys []*Deploy, trackers []Tracker, progress func(strategy string, e Event)) []Result {
+	results := make([]Result, len(trackers))
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	start := time.Now()
+	for i, t := range trackers {
+		i, t := i, t
+		results[i].Strategy = t.Name()
+		seen := make(map[string]bool)
+
+		for _, deploy := range deploys {
+			deploy := deploy
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := t.Track(ctx, deploy, func(e Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					if e.Pod != "" && !seen[e.Pod] {
+						seen[e.Pod] = true
+						results[i].Pods = append(results[i].Pods, e.Pod)
+					}
+					progress(t.Name(), e)
+				})
+
+				mu.Lock()
+				defer mu.Unlock()
+				results[i].Elapsed = time.Since(start)
+				if err != nil && results[i].Err == nil {
+					results[i].Err = err
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return results
+}
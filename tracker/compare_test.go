@@ -0,0 +1,129 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// A Tracker that reports the same pods for every workload, then decides
+// after a delay. It fails the workloads in failOn.
+type scriptedTracker struct {
+	name   string
+	pods   []string
+	delay  time.Duration
+	failOn map[string]bool
+}
+
+func (t scriptedTracker) Name() string {
+	return t.name
+}
+
+func (scriptedTracker) Prepare(deploy *Deploy) error {
+	return nil
+}
+
+func (t scriptedTracker) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	for _, pod := range t.pods {
+		progress.report(pod, "%s: pod %s of %s", t.name, pod, deploy.Name())
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(t.delay):
+	}
+	if t.failOn[deploy.Name()] {
+		return fmt.Errorf("%s failed", deploy.Name())
+	}
+	return nil
+}
+
+func testDeploys(names ...string) []*Deploy {
+	result := []*Deploy{}
+	for _, name := range names {
+		workload := &unstructured.Unstructured{}
+		workload.SetAPIVersion("apps/v1")
+		workload.SetKind("Deployment")
+		workload.SetName(name)
+		result = append(result, &Deploy{ID: "test", Workload: workload})
+	}
+	return result
+}
+
+func TestCompare(t *testing.T) {
+	var inProgress, overlaps int32
+	trackers := []Tracker{
+		scriptedTracker{name: "slow", pods: []string{"a", "b"}, delay: 100 * time.Millisecond},
+		scriptedTracker{name: "fast", pods: []string{"b", "a", "b"}},
+		scriptedTracker{name: "failing", pods: []string{"c"}, failOn: map[string]bool{"db": true}},
+		scriptedTracker{name: "hanging", delay: time.Hour},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	events := 0
+	start := time.Now()
+	results := Compare(ctx, testDeploys("web", "db"), trackers, func(strategy string, e Event) {
+		if atomic.AddInt32(&inProgress, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&inProgress, -1)
+		time.Sleep(time.Millisecond)
+		events++
+	})
+	elapsed := time.Since(start)
+
+	strategies := []string{}
+	for _, r := range results {
+		strategies = append(strategies, r.Strategy)
+	}
+	if want := []string{"slow", "fast", "failing", "hanging"}; !reflect.DeepEqual(strategies, want) {
+		t.Fatalf("expected results in the order of the trackers, %v, got %v", want, strategies)
+	}
+
+	// Each pod only counts once, across every workload.
+	for _, tc := range []struct {
+		result Result
+		pods   []string
+	}{
+		{results[0], []string{"a", "b"}},
+		{results[1], []string{"b", "a"}},
+		{results[2], []string{"c"}},
+		{results[3], nil},
+	} {
+		if !reflect.DeepEqual(tc.result.Pods, tc.pods) {
+			t.Errorf("expected %s to see pods %v, got %v", tc.result.Strategy, tc.pods, tc.result.Pods)
+		}
+	}
+
+	// A tracker fails if any workload fails.
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("expected slow and fast to succeed, got %v and %v", results[0].Err, results[1].Err)
+	}
+	if results[2].Err == nil || results[2].Err.Error() != "db failed" {
+		t.Errorf("expected failing to fail on db, got %v", results[2].Err)
+	}
+	if results[3].Err != context.DeadlineExceeded {
+		t.Errorf("expected hanging to time out, got %v", results[3].Err)
+	}
+
+	// A tracker decides when its last workload does.
+	if results[0].Elapsed < 100*time.Millisecond || results[0].Elapsed > elapsed {
+		t.Errorf("expected slow to take at least 100ms, got %s", results[0].Elapsed)
+	}
+	if results[1].Elapsed > results[0].Elapsed {
+		t.Errorf("expected fast to beat slow, got %s and %s", results[1].Elapsed, results[0].Elapsed)
+	}
+
+	if events != 2*(2+3+1) {
+		t.Errorf("expected every event to be reported, got %d", events)
+	}
+	if overlaps != 0 {
+		t.Errorf("expected progress to be called one at a time, got %d overlapping calls", overlaps)
+	}
+}
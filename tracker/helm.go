@@ -0,0 +1,91 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Uses the approach of `helm --wait`, looking up the replicaset and waiting
+// for it to report success.
+type Helm struct {
+	getter  genericclioptions.RESTClientGetter
+	timeout time.Duration
+}
+
+var _ Tracker = Helm{}
+
+// NewHelm uses the Helm Kube client off the shelf. A nil getter
+// uses the default kubeconfig, the same as kube.New(nil).
+func NewHelm(getter genericclioptions.RESTClientGetter) Helm {
+	return Helm{getter: getter, timeout: 15 * time.Second}
+}
+
+func (Helm) Name() string {
+	return StrategyHelm
+}
+
+func (Helm) Prepare(deploy *Deploy) error {
+	return nil
+}
+
+func (t Helm) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	helmKubeClient := kube.New(t.getter)
+	helmKubeClient.Log = func(f string, args ...interface{}) {
+		progress.report("", f, args...)
+	}
+
+	obj, err := typedWorkload(deploy)
+	if err != nil {
+		return err
+	}
+
+	res := &resource.Info{
+		Namespace: deploy.Namespace(),
+		Name:      deploy.Name(),
+		Object:    obj,
+	}
+	resList := []*resource.Info{res}
+
+	progress.report("", "helm wait %s", deploy.Name())
+
+	// Helm's Wait isn't cancellable, so if ctx is done first we stop listening
+	// and let it time out on its own.
+	result := make(chan error, 1)
+	go func() {
+		result <- helmKubeClient.Wait(resList, t.timeout)
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("helm wait: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Helm only waits on the typed objects it knows, like Deployments and Jobs.
+// It skips anything else, like custom resources.
+func typedWorkload(deploy *Deploy) (runtime.Object, error) {
+	obj, err := scheme.Scheme.New(deploy.Workload.GroupVersionKind())
+	if runtime.IsNotRegisteredError(err) {
+		return deploy.Workload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(deploy.Workload.Object, obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,62 @@
+package tracker
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/tilt-dev/kubectl-blame-examples/3-kubespy/kubespy"
+)
+
+// Uses the approach of `kubespy trace`, using owner references to find everything.
+type Kubespy struct {
+	// Where to render the kubespy trace table.
+	Out io.Writer
+
+	watch func(namespace, name string) (kubespy.DeploymentEvents, error)
+}
+
+var _ Tracker = Kubespy{}
+
+// NewKubespy creates a Kubespy tracker that reads events from watch,
+// e.g., kubespy.WatchDeployment.
+func NewKubespy(watch func(namespace, name string) (kubespy.DeploymentEvents, error)) Kubespy {
+	return Kubespy{Out: os.Stdout, watch: watch}
+}
+
+func (Kubespy) Name() string {
+	return StrategyKubespy
+}
+
+// Prepare fails on anything but a Deployment, before it's applied.
+func (Kubespy) Prepare(deploy *Deploy) error {
+	return deploy.requireDeployment(StrategyKubespy)
+}
+
+func (t Kubespy) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	err := deploy.requireDeployment(StrategyKubespy)
+	if err != nil {
+		return err
+	}
+
+	ns := deploy.Namespace()
+	name := deploy.Name()
+	progress.report("", "kubespy trace %s", name)
+
+	events, err := t.watch(ns, name)
+	if err != nil {
+		return err
+	}
+	if events.Stop != nil {
+		defer events.Stop()
+	}
+
+	return kubespy.TraceDeployment(ctx, ns, name, events, t.Out, func(status string, pods []string) {
+		if len(pods) == 0 {
+			progress.report("", "%s", status)
+		}
+		for _, pod := range pods {
+			progress.report(pod, "%s | Pod: %s", status, pod)
+		}
+	})
+}
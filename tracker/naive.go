@@ -0,0 +1,81 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+const naiveLabelKey = "tilt.dev/deploy"
+
+// Creates a random label for each deployment. Watches that label.
+type Naive struct {
+	kCli kubernetes.Interface
+
+	// The clock for pod ages. nil uses time.Now.
+	now func() time.Time
+}
+
+var _ Tracker = Naive{}
+
+func NewNaive(kCli kubernetes.Interface) Naive {
+	return Naive{kCli: kCli}
+}
+
+// WithClock reports pod ages from now instead of the real clock, e.g., for a
+// simulated cluster.
+func (t Naive) WithClock(now func() time.Time) Naive {
+	t.now = now
+	return t
+}
+
+func (Naive) Name() string {
+	return StrategyNaive
+}
+
+func (Naive) Prepare(deploy *Deploy) error {
+	labelValue := fmt.Sprintf("deploy-%s", deploy.ID)
+	fmt.Printf("[go] Adding label key=value %s=%s\n", naiveLabelKey, labelValue)
+
+	labels := deploy.Workload.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[naiveLabelKey] = labelValue
+	deploy.Workload.SetLabels(labels)
+	return deploy.PodTemplatePaths.SetPodTemplateLabel(deploy.Workload, naiveLabelKey, labelValue)
+}
+
+func (t Naive) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	template, err := deploy.PodTemplate()
+	if err != nil {
+		return err
+	}
+	labelValue := template.ObjectMeta.Labels[naiveLabelKey]
+	if labelValue == "" {
+		return fmt.Errorf("%s %s is missing label %s", deploy.Kind(), deploy.Name(), naiveLabelKey)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Watch for changes
+	factory := informers.NewSharedInformerFactoryWithOptions(t.kCli, 5*time.Minute,
+		informers.WithNamespace(deploy.Namespace()),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = fmt.Sprintf("%s=%s", naiveLabelKey, labelValue)
+		}))
+	resFactory, err := factory.ForResource(v1.SchemeGroupVersion.WithResource("pods"))
+	if err != nil {
+		return err
+	}
+
+	printer := newPodStatusPrinter(progress, t.now)
+	runPodInformer(ctx, resFactory.Informer(), printer.OnChange)
+	return printer.Wait(ctx)
+}
@@ -0,0 +1,152 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func runPodInformer(ctx context.Context, informer cache.SharedInformer, podCallback func(pod *v1.Pod)) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod, ok := obj.(*v1.Pod)
+			if ok {
+				podCallback(pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			pod, ok := obj.(*v1.Pod)
+			if ok {
+				podCallback(pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*v1.Pod)
+			if ok {
+				podCallback(pod)
+			}
+		},
+	})
+	go informer.Run(ctx.Done())
+}
+
+// Container waiting reasons that the pod won't recover from without a new
+// deploy.
+var terminalWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"CreateContainerConfigError": true,
+}
+
+// Reports each pod's phase and container status as they change,
+// and closes done the first time a pod is running, or has succeeded, for
+// Jobs that finish before we see them run, or the first time a pod fails.
+type podStatusPrinter struct {
+	progress          Progress
+	now               func() time.Time
+	phases            map[string]string
+	containerStatuses map[string]string
+	done              chan struct{}
+
+	// Why the deploy failed, if it did. Set before done is closed.
+	err error
+}
+
+// now is the clock for pod ages. nil uses time.Now.
+func newPodStatusPrinter(progress Progress, now func() time.Time) *podStatusPrinter {
+	if now == nil {
+		now = time.Now
+	}
+	return &podStatusPrinter{
+		progress:          progress,
+		now:               now,
+		phases:            make(map[string]string),
+		containerStatuses: make(map[string]string),
+		done:              make(chan struct{}),
+	}
+}
+
+func (p *podStatusPrinter) OnChange(pod *v1.Pod) {
+	name := pod.Name
+	phase := podPhase(pod)
+	cStatus := containerStatus(pod)
+
+	if p.phases[name] == phase && p.containerStatuses[name] == cStatus {
+		return
+	}
+
+	p.phases[name] = phase
+	p.containerStatuses[name] = cStatus
+	p.progress.report(name, "Pod: %s | Phase: %s | Container: %s | Age: %s", name, phase, cStatus, prettyAge(pod, p.now()))
+
+	err := podFailure(pod)
+	if err != nil || (phase == "Running" && cStatus == "Running") || phase == string(v1.PodSucceeded) {
+		select {
+		case <-p.done:
+		default:
+			p.err = err
+			close(p.done)
+		}
+	}
+}
+
+// Blocks until a pod is running or has succeeded (returns nil), a pod has
+// failed (returns an error), or ctx is done.
+func (p *podStatusPrinter) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func podPhase(pod *v1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "Terminating"
+	}
+	return string(pod.Status.Phase)
+}
+
+func containerStatus(pod *v1.Pod) string {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return ""
+	}
+
+	state := pod.Status.ContainerStatuses[0].State
+	if state.Waiting != nil {
+		return state.Waiting.Reason
+	} else if state.Running != nil {
+		return "Running"
+	} else if state.Terminated != nil {
+		return state.Terminated.Reason
+	}
+	return ""
+}
+
+// Why a pod won't run, or nil if it still might.
+func podFailure(pod *v1.Pod) error {
+	if pod.Status.Phase == v1.PodFailed {
+		return fmt.Errorf("Pod %s failed: %s", pod.Name, pod.Status.Reason)
+	}
+
+	statuses := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting != nil && terminalWaitingReasons[waiting.Reason] {
+			return fmt.Errorf("Pod %s: container %s is in %s", pod.Name, status.Name, waiting.Reason)
+		}
+	}
+	return nil
+}
+
+func prettyAge(pod *v1.Pod, now time.Time) string {
+	t := pod.CreationTimestamp.Time
+	dur := now.Sub(t)
+	return fmt.Sprintf("%.3fs", float64(dur)/float64(time.Second))
+}
@@ -0,0 +1,43 @@
+package tracker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tilt-dev/kubectl-blame-examples/1-kubectl-rollout/rollout"
+	"k8s.io/client-go/dynamic"
+)
+
+// Uses the approach of `kubectl rollout status`, waiting for the deployment
+// to report success.
+type Rollout struct {
+	dCli dynamic.Interface
+}
+
+var _ Tracker = Rollout{}
+
+func NewRollout(dCli dynamic.Interface) Rollout {
+	return Rollout{dCli: dCli}
+}
+
+func (Rollout) Name() string {
+	return StrategyRollout
+}
+
+// Prepare fails on anything but a Deployment, before it's applied.
+func (Rollout) Prepare(deploy *Deploy) error {
+	return deploy.requireDeployment(StrategyRollout)
+}
+
+func (t Rollout) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	err := deploy.requireDeployment(StrategyRollout)
+	if err != nil {
+		return err
+	}
+
+	name := deploy.Name()
+	progress.report("", "kubectl rollout status deployment %s --watch", name)
+	return rollout.WatchRollout(ctx, t.dCli, deploy.Namespace(), name, 0, func(status string) {
+		progress.report("", "%s", strings.TrimSpace(status))
+	})
+}
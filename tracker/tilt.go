@@ -0,0 +1,155 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Uses the current Tilt approach, with a combination of owner refs and
+// template hashes.
+type Tilt struct {
+	kCli         kubernetes.Interface
+	ownerFetcher *tilt.OwnerFetcher
+
+	// Where to load and save the OwnerFetcher's snapshot. Empty if we don't.
+	snapshotPath string
+	cluster      string
+
+	// The clock for pod ages. nil uses time.Now.
+	now func() time.Time
+}
+
+var _ Tracker = Tilt{}
+
+func NewTilt(kCli kubernetes.Interface, ownerFetcher *tilt.OwnerFetcher) Tilt {
+	return Tilt{kCli: kCli, ownerFetcher: ownerFetcher}
+}
+
+// WithSnapshot warms the OwnerFetcher from the snapshot at path, if there
+// is one, and saves a new one on Close.
+func (t Tilt) WithSnapshot(path, cluster string) Tilt {
+	err := t.ownerFetcher.LoadSnapshotFile(path, cluster)
+	if err != nil {
+		log.Printf("Ignoring owner cache %s: %v", path, err)
+	}
+	t.snapshotPath = path
+	t.cluster = cluster
+	return t
+}
+
+// WithClock reports pod ages from now instead of the real clock, e.g., for a
+// simulated cluster.
+func (t Tilt) WithClock(now func() time.Time) Tilt {
+	t.now = now
+	return t
+}
+
+// Close saves the snapshot, if we're keeping one, and stops the
+// OwnerFetcher's watches.
+func (t Tilt) Close() error {
+	if t.snapshotPath != "" {
+		err := t.ownerFetcher.SaveSnapshotFile(t.snapshotPath, t.cluster)
+		if err != nil {
+			log.Printf("Saving owner cache %s: %v", t.snapshotPath, err)
+		}
+	}
+	return t.ownerFetcher.Close()
+}
+
+func (Tilt) Name() string {
+	return StrategyTilt
+}
+
+// Prepare labels the pod template with its hash, and fingerprints each part
+// too, so that 'kubectl blame template-diff' can tell what changed between
+// two pods.
+func (Tilt) Prepare(deploy *Deploy) error {
+	hash, err := deploy.PodTemplatePaths.InjectPodTemplateHash(deploy.Workload)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[go] Added template hash so we can trace the pod: %s\n", hash)
+	return nil
+}
+
+func (t Tilt) Track(ctx context.Context, deploy *Deploy, progress Progress) error {
+	template, err := deploy.PodTemplate()
+	if err != nil {
+		return err
+	}
+	hash := template.ObjectMeta.Labels[tilt.TiltPodTemplateHashLabel]
+	if hash == "" {
+		return fmt.Errorf("%s %s is missing label %s", deploy.Kind(), deploy.Name(), tilt.TiltPodTemplateHashLabel)
+	}
+
+	// Pods can be owned by the workload, by a ReplicaSet it owns, or by a Job
+	// that a CronJob owns, so we look for the workload anywhere in the tree.
+	uid := deploy.Workload.GetUID()
+	if uid == "" {
+		return fmt.Errorf("%s %s has no UID. Has it been applied?", deploy.Kind(), deploy.Name())
+	}
+	progress.report("", "tilt find pods owned by UID %s", uid)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ignored := make(map[string]bool)
+
+	// Pods labeled by an older version of the hash still match if they came
+	// from the same template.
+	compatible := map[tilt.PodTemplateSpecHash]bool{tilt.PodTemplateSpecHash(hash): true}
+	matchesTemplate := func(podHash tilt.PodTemplateSpecHash) bool {
+		ok, seen := compatible[podHash]
+		if !seen {
+			ok, _ = tilt.MatchesPodTemplateSpec(podHash, template)
+			compatible[podHash] = ok
+		}
+		return ok
+	}
+
+	// Watch for changes
+	factory := informers.NewSharedInformerFactoryWithOptions(t.kCli, 5*time.Minute,
+		informers.WithNamespace(deploy.Namespace()))
+	resFactory, err := factory.ForResource(v1.SchemeGroupVersion.WithResource("pods"))
+	if err != nil {
+		return err
+	}
+
+	printer := newPodStatusPrinter(progress, t.now)
+	runPodInformer(ctx, resFactory.Informer(), func(pod *v1.Pod) {
+		tree, err := t.ownerFetcher.OwnerTreeOf(ctx, pod)
+		if err != nil {
+			log.Printf("error fetching owner tree: %v", err)
+
+			// A cycle still gives us a partial tree to check.
+			_, isCycle := err.(*tilt.CycleError)
+			if !isCycle {
+				return
+			}
+		}
+
+		if !tree.ContainsUID(uid) {
+			return
+		}
+
+		if !matchesTemplate(tilt.PodTemplateSpecHash(pod.Labels[tilt.TiltPodTemplateHashLabel])) {
+			if !ignored[pod.Name] {
+				progress.report("", "Pod: %s | Ignoring | (pod template hash doesn't match)", pod.Name)
+				ignored[pod.Name] = true
+			}
+			return
+		}
+
+		printer.OnChange(pod)
+	})
+
+	// Wait until deployed
+	return printer.Wait(ctx)
+}
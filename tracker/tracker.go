@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tilt-dev/kubectl-blame-examples/4-tilt/tilt"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The strategies for deciding when a deploy is done, in the order the talk
+// presents them.
+const (
+	StrategyNaive   = "naive"
+	StrategyRollout = "rollout"
+	StrategyHelm    = "helm"
+	StrategyKubespy = "kubespy"
+	StrategyTilt    = "tilt"
+)
+
+var Strategies = []string{StrategyNaive, StrategyRollout, StrategyHelm, StrategyKubespy, StrategyTilt}
+
+var deploymentGK = schema.GroupKind{Group: "apps", Kind: "Deployment"}
+
+// A Deploy is a single run of the build/apply pipeline.
+type Deploy struct {
+	// A random, human-readable identifier for this deploy.
+	ID string
+
+	// Before the deploy is applied, the workload from the manifest.
+	// After it's applied, the workload returned by the server.
+	//
+	// The workload is a Deployment, StatefulSet, DaemonSet, ReplicaSet, Job,
+	// CronJob, or a custom resource in PodTemplatePaths.
+	Workload *unstructured.Unstructured
+
+	// Where custom resources keep their pod templates.
+	PodTemplatePaths tilt.PodTemplatePaths
+}
+
+func (d *Deploy) Namespace() string {
+	if d.Workload.GetNamespace() == "" {
+		return "default"
+	}
+	return d.Workload.GetNamespace()
+}
+
+func (d *Deploy) Name() string {
+	return d.Workload.GetName()
+}
+
+func (d *Deploy) Kind() string {
+	return d.Workload.GetKind()
+}
+
+// Deployment converts the workload to a Deployment, for trackers that only
+// understand Deployments.
+func (d *Deploy) Deployment() (*appsv1.Deployment, error) {
+	if d.Workload.GroupVersionKind().GroupKind() != deploymentGK {
+		return nil, fmt.Errorf("%s %s isn't a Deployment", d.Kind(), d.Name())
+	}
+	deployment := &appsv1.Deployment{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(d.Workload.Object, deployment)
+	if err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// SetDeployment replaces the workload with a modified Deployment.
+func (d *Deploy) SetDeployment(deployment *appsv1.Deployment) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
+	if err != nil {
+		return err
+	}
+	d.Workload = &unstructured.Unstructured{Object: content}
+	return nil
+}
+
+// PodTemplate reads the workload's pod template.
+func (d *Deploy) PodTemplate() (*v1.PodTemplateSpec, error) {
+	return d.PodTemplatePaths.PodTemplateOf(d.Workload)
+}
+
+// Only Deployments report their rollout status the way the rollout and
+// kubespy strategies expect.
+func (d *Deploy) requireDeployment(strategy string) error {
+	if d.Workload.GroupVersionKind().GroupKind() != deploymentGK {
+		return fmt.Errorf("The %s strategy only tracks Deployments, not %s %s", strategy, d.Kind(), d.Name())
+	}
+	return nil
+}
+
+// An Event is a progress update from a Tracker.
+type Event struct {
+	Time time.Time
+
+	// The pod this event is about, if any.
+	Pod string
+
+	Message string
+}
+
+type Progress func(e Event)
+
+func (p Progress) report(pod string, format string, args ...interface{}) {
+	p(Event{
+		Time:    time.Now(),
+		Pod:     pod,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// A Tracker decides when a deploy is done.
+type Tracker interface {
+	// The strategy name.
+	Name() string
+
+	// Modifies the workload before it's applied, e.g., to add labels that
+	// the Tracker uses to find its pods.
+	Prepare(deploy *Deploy) error
+
+	// Blocks until the applied workload has rolled out successfully (returns nil),
+	// the rollout has failed (returns an error), or ctx is done.
+	Track(ctx context.Context, deploy *Deploy, progress Progress) error
+}
+
+// Close releases anything a Tracker holds open, like watches, if it has a
+// Close method.
+func Close(t Tracker) error {
+	closer, ok := t.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// New creates the Tracker for a strategy.
+func New(ctx context.Context, strategy string, clients Clients) (Tracker, error) {
+	switch strategy {
+	case StrategyNaive:
+		return NewNaive(clients.Kube).WithClock(clients.Now), nil
+	case StrategyRollout:
+		return NewRollout(clients.Dynamic), nil
+	case StrategyHelm:
+		return NewHelm(clients.HelmGetter), nil
+	case StrategyKubespy:
+		return NewKubespy(clients.KubespyWatch), nil
+	case StrategyTilt:
+		ownerFetcher := tilt.NewOwnerFetcherForClients(ctx, clients.Mapper, clients.Metadata)
+		if clients.MetadataInformers != nil {
+			ownerFetcher = tilt.NewOwnerFetcherForInformers(ctx, clients.Mapper, clients.Metadata, clients.MetadataInformers)
+		}
+		ownerFetcher.WithCacheOptions(clients.OwnerCacheOptions)
+		t := NewTilt(clients.Kube, ownerFetcher).WithClock(clients.Now)
+		if clients.OwnerCacheDir != "" && clients.MetadataInformers == nil {
+			t = t.WithSnapshot(ownerFetcher.SnapshotPath(clients.OwnerCacheDir, clients.Cluster), clients.Cluster)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("Unknown strategy %q. Must be one of: %v", strategy, Strategies)
+}
@@ -0,0 +1,21 @@
+package tracker
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDeploymentTrackersRejectOtherKindsBeforeApply(t *testing.T) {
+	workload := &unstructured.Unstructured{}
+	workload.SetAPIVersion("apps/v1")
+	workload.SetKind("StatefulSet")
+	workload.SetName("db")
+
+	for _, tr := range []Tracker{Rollout{}, Kubespy{}} {
+		err := tr.Prepare(&Deploy{ID: "test", Workload: workload})
+		if err == nil {
+			t.Errorf("expected %s to reject a StatefulSet", tr.Name())
+		}
+	}
+}